@@ -0,0 +1,32 @@
+package exec
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// statInRoot reports an error if there is no file at path in the directory root,
+// resolving symbolic links as if root were the root directory.
+func statInRoot(root string, path string) error {
+	dirfd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(dirfd)
+	fd, err := unix.Openat2(dirfd, path, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT,
+	})
+	if errors.Is(err, unix.ENOSYS) {
+		// openat2(2) is new in Linux 5.6.
+		_, err = os.Stat(filepath.Join(root, path))
+		return err
+	}
+	if err != nil {
+		return &os.PathError{Op: "stat", Path: filepath.Join(root, path), Err: err}
+	}
+	return unix.Close(fd)
+}
@@ -0,0 +1,15 @@
+//go:build unix && !linux
+
+package exec
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// statInRoot reports an error if there is no file at path in the directory root.
+// Unlike on Linux, symbolic links are resolved outside of root.
+func statInRoot(root string, path string) error {
+	_, err := os.Stat(filepath.Join(root, path))
+	return err
+}
@@ -0,0 +1,40 @@
+//go:build unix
+
+package exec
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// inChroot returns argv0 and attr with the paths resolved inside the new root
+// directory that attr.Sys asks for: the working directory is the new root directory
+// unless attr.Dir says otherwise, a relative attr.Dir is relative to the new root
+// directory, and a relative argv0 is relative to the working directory in it.
+// Otherwise, the new program could start with a working directory outside of its
+// root directory, from which it could escape.
+func inChroot(argv0 string, attr *syscall.ProcAttr) (string, *syscall.ProcAttr) {
+	chrooted := *attr
+	chrooted.Dir = path.Join("/", attr.Dir)
+	if !filepath.IsAbs(argv0) {
+		argv0 = path.Join(chrooted.Dir, argv0)
+	}
+	return argv0, &chrooted
+}
+
+// chroot is the step that makes root the root directory, once it has made sure that
+// the new program at argv0 exists in it, so that a missing program is reported as
+// such rather than as a failing execve(2).
+func chroot(s *execState, root string, argv0 string) error {
+	return s.do("chroot", fmt.Sprintf("chroot(%q)", root), func() error {
+		err := statInRoot(root, argv0)
+		if err != nil {
+			return err
+		}
+		return unix.Chroot(root)
+	})
+}
@@ -25,57 +25,108 @@ type CmdExt exec.Cmd
 // Exec is similar to [os/exec.Cmd.Start]. Instead of spawning a new process, it replaces
 // the current process with the new one using [syscall.Exec].
 //
-// Exec always returns a non-nil error.
+// Unlike with Start, a nil Stdin, Stdout or Stderr is inherited from the current
+// process rather than connected to the null device. Use [ExecOptions.NullStdio] to get
+// the behavior of Start. A non-nil Stdin, Stdout or Stderr must have a file descriptor
+// that the new program can inherit: besides an [*os.File], Exec accepts a network
+// connection like [*net.TCPConn] and any value that [RegisterFileUnwrapper] describes.
+// A Stdin of known size, like a [*strings.Reader], is copied into an anonymous file
+// instead; see [ExecOptions.MaxStdinBuffer]. A Stdin that has buffered some bytes
+// before the rest of a file, like a [*bufio.Reader] of [os.Stdin] or an
+// [io.MultiReader] of a [*bytes.Reader] and os.Stdin, is relayed through a pipe by a
+// copy of the current executable, which first writes the buffered bytes. See
+// [CmdExt.ExecWith] for the details.
+//
+// Exec always returns a non-nil error. When it does, c is unchanged, so the command
+// can still be run with [os/exec.Cmd.Run] or similar instead.
 func (c *CmdExt) Exec() error {
-	var stdin, stdout, stderr *os.File
-	var ok bool
-	if c.Stdin != nil {
-		stdin, ok = c.Stdin.(*os.File)
-		if !ok {
-			return errors.New("exec: Stdin is not an *os.File")
-		}
-	} else {
-		stdin = os.Stdin
-	}
-	if c.Stdout != nil {
-		stdout, ok = c.Stdout.(*os.File)
-		if !ok {
-			return errors.New("exec: Stdout is not an *os.File")
-		}
-	} else {
-		stdout = os.Stdout
+	return c.ExecWith(nil)
+}
+
+// ExecWith is like [CmdExt.Exec] but takes additional options. See [ExecOptions].
+//
+// The relay process that Exec starts for a Stdin with buffered bytes is a copy of
+// the current executable, so the init functions of the packages initialized before
+// this one run in it too. It only starts reading from Stdin once Exec has succeeded.
+// It becomes a child of the new program, and reports an error reading from Stdin on
+// the standard error of the current process before it closes the pipe.
+func (c *CmdExt) ExecWith(opts *ExecOptions) error {
+	// Setting up stdio may read from Stdin or start a relay process, so an Exec that
+	// would fail anyway must fail before that.
+	err := c.ensureIsBuilding()
+	if err != nil {
+		return err
 	}
-	if c.Stderr != nil {
-		stderr, ok = c.Stderr.(*os.File)
-		if !ok {
-			return errors.New("exec: Stderr is not an *os.File")
-		}
-	} else {
-		stderr = os.Stderr
+	if !execInProgress.CompareAndSwap(false, true) {
+		return ErrExecInProgress
 	}
-	c.Stdin, c.Stdout, c.Stderr = stdin, stdout, stderr
+	defer execInProgress.Store(false)
 
-	path, argv, attr, err := c.lower(stdin, stdout, stderr)
+	files := &stdioFiles{opts: opts}
+	defer files.Close()
+	stdin, stdout, stderr, err := c.stdio(files)
 	if err != nil {
 		return err
 	}
-	return ExecProcess(path, argv, attr)
+	files.extraFiles(c.ExtraFiles)
+
+	path, argv, attr := c.lower(stdin, stdout, stderr)
+	return execProcessWith(path, argv, attr, opts)
+}
+
+// Plan is like [CmdExt.Exec], but instead of replacing the current process it returns
+// the [ExecPlan] that Exec would carry out. See [PlanProcess].
+func (c *CmdExt) Plan() (*ExecPlan, error) {
+	return c.PlanWith(nil)
 }
 
-// lower lowers an [exec.Cmd] instance into the arguments required by [os.StartProcess] and [ExecProcess].
-func (c *CmdExt) lower(stdin, stdout, stderr *os.File) (path string, argv []string, attr *os.ProcAttr, err error) {
-	err = c.ensureIsBuilding()
+// PlanWith is like [CmdExt.Plan] but takes the same additional options as
+// [CmdExt.ExecWith].
+func (c *CmdExt) PlanWith(opts *ExecOptions) (*ExecPlan, error) {
+	err := c.ensureIsBuilding()
+	if err != nil {
+		return nil, err
+	}
+
+	files := &stdioFiles{opts: opts, plan: true}
+	defer files.Close()
+	stdin, stdout, stderr, err := c.stdio(files)
 	if err != nil {
-		return "", nil, nil, err
+		return nil, err
 	}
+	files.extraFiles(c.ExtraFiles)
 
-	path = c.Path
-	argv = c.argv()
-	attr, err = c.attr(stdin, stdout, stderr)
+	path, argv, attr := c.lower(stdin, stdout, stderr)
+	plan, err := PlanProcessWith(path, argv, attr, opts)
 	if err != nil {
-		return "", nil, nil, err
+		return nil, err
 	}
-	return path, argv, attr, nil
+	plan.Steps = append(files.steps, plan.Steps...)
+	return plan, nil
+}
+
+// stdio returns the [*os.File] instances to use as the standard input, output and
+// error of the new process.
+func (c *CmdExt) stdio(files *stdioFiles) (stdin, stdout, stderr *os.File, err error) {
+	stdin, err = files.file("Stdin", c.Stdin, os.Stdin, os.O_RDONLY)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stdout, err = files.file("Stdout", c.Stdout, os.Stdout, os.O_WRONLY)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stderr, err = files.file("Stderr", c.Stderr, os.Stderr, os.O_WRONLY)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return stdin, stdout, stderr, nil
+}
+
+// lower lowers an [exec.Cmd] instance, which ensureIsBuilding has accepted, into the
+// arguments required by [os.StartProcess] and [ExecProcess].
+func (c *CmdExt) lower(stdin, stdout, stderr *os.File) (path string, argv []string, attr *os.ProcAttr) {
+	return c.Path, c.argv(), c.attr(stdin, stdout, stderr)
 }
 
 func (c *CmdExt) ctx() context.Context {
@@ -96,7 +147,7 @@ func (c *CmdExt) ensureIsBuilding() error {
 
 	lookPathErr := c.lookPathErr()
 	if c.Path == "" && c.Err == nil && lookPathErr == nil {
-		c.Err = errors.New("exec: no command")
+		return errors.New("exec: no command")
 	}
 	if c.Err != nil || lookPathErr != nil {
 		if lookPathErr != nil {
@@ -133,7 +184,7 @@ func (c *CmdExt) argv() []string {
 // Stdout, and Stderr fields are of type [io.Reader] and [io.Writer] respectively; they don't have file descriptors.
 // Callers are free to preprocess Stdin, Stdout, and Stderr as needed
 // and provide the underlying [*os.File] instances to this method.
-func (c *CmdExt) attr(stdin, stdout, stderr *os.File) (*os.ProcAttr, error) {
+func (c *CmdExt) attr(stdin, stdout, stderr *os.File) *os.ProcAttr {
 	files := make([]*os.File, 3, 3+len(c.ExtraFiles))
 	files[0] = stdin
 	files[1] = stdout
@@ -142,10 +193,10 @@ func (c *CmdExt) attr(stdin, stdout, stderr *os.File) (*os.ProcAttr, error) {
 
 	env := (*exec.Cmd)(c).Environ() // Swallows error
 
-	return (&os.ProcAttr{
+	return &os.ProcAttr{
 		Dir:   c.Dir,
 		Files: files,
 		Env:   env,
 		Sys:   c.SysProcAttr,
-	}), nil
+	}
 }
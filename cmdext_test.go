@@ -4,9 +4,15 @@ package exec_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"slices"
+	"strings"
 	"testing"
 
 	jcbhmrexec "github.com/jcbhmr/go-exec"
@@ -34,3 +40,133 @@ func ExampleCmdExt_Exec() {
 	cmd := exec.Command("go", os.Args[1:]...)
 	log.Fatal((*jcbhmrexec.CmdExt)(cmd).Exec())
 }
+
+func TestCmdExtPlan(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("go", "version")
+	cmd.Dir = os.TempDir()
+	plan, err := (*jcbhmrexec.CmdExt)(cmd).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plan.Path != cmd.Path {
+		t.Errorf("expected Path %q, got %q", cmd.Path, plan.Path)
+	}
+	if len(plan.Files) != 3 {
+		t.Errorf("expected 3 files, got %v", plan.Files)
+	}
+	var ops []string
+	for _, s := range plan.Steps {
+		ops = append(ops, s.Op)
+	}
+	if !slices.Contains(ops, "chdir") || ops[len(ops)-1] != "execve" {
+		t.Errorf("unexpected steps:\n%s", plan)
+	}
+	if _, err := json.Marshal(plan); err != nil {
+		t.Error(err)
+	}
+
+	if wd2, _ := os.Getwd(); wd2 != wd {
+		t.Fatalf("Plan changed the working directory to %q", wd2)
+	}
+}
+
+func ExampleCmdExt_Plan() {
+	cmd := exec.Command("go", os.Args[1:]...)
+	plan, err := (*jcbhmrexec.CmdExt)(cmd).Plan()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(plan)
+}
+
+func TestCmdExtExecUnchangedOnError(t *testing.T) {
+	cmd := exec.Command("cat")
+	cmd.Dir = "/nonexistent/go-exec-test"
+	before := *cmd
+
+	err := (*jcbhmrexec.CmdExt)(cmd).Exec()
+	if err == nil {
+		t.Fatal("expected Exec to fail")
+	}
+	if cmd.Stdin != before.Stdin || cmd.Stdout != before.Stdout || cmd.Stderr != before.Stderr ||
+		cmd.Err != before.Err || cmd.Process != before.Process {
+		t.Fatalf("Exec changed the Cmd: %+v, expected %+v", cmd, before)
+	}
+
+	// Falling back to Run behaves as if Exec had never been called: a nil Stdin is
+	// the null device, so cat exits right away.
+	cmd.Dir = ""
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%q failed: %v", cmd, err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("expected no output, got %q", out)
+	}
+}
+
+func TestCmdExtExecNoCommand(t *testing.T) {
+	cmd := &exec.Cmd{}
+	if err := (*jcbhmrexec.CmdExt)(cmd).Exec(); err == nil {
+		t.Fatal("expected Exec to fail")
+	}
+	if cmd.Err != nil {
+		t.Fatalf("Exec set Err to %v", cmd.Err)
+	}
+}
+
+func TestCmdExtExecNoFd(t *testing.T) {
+	cmd := exec.Command("true")
+	cmd.Stdout = &bytes.Buffer{}
+	_, err := (*jcbhmrexec.CmdExt)(cmd).Plan()
+	if err == nil || !strings.Contains(err.Error(), "Stdout") {
+		t.Fatalf("expected an error about Stdout, got %v", err)
+	}
+}
+
+func TestCmdExtPlanReaderStdin(t *testing.T) {
+	r := strings.NewReader("hello\n")
+	cmd := exec.Command("cat")
+	cmd.Stdin = r
+	if _, err := (*jcbhmrexec.CmdExt)(cmd).Plan(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != len("hello\n") {
+		t.Fatalf("expected Plan to leave Stdin unread, %d bytes left", r.Len())
+	}
+
+	cmd.Stdin = io.MultiReader(r)
+	if _, err := (*jcbhmrexec.CmdExt)(cmd).Plan(); err == nil {
+		t.Fatal("expected a Stdin of unknown size to be an error")
+	}
+
+	plan, err := (*jcbhmrexec.CmdExt)(cmd).PlanWith(&jcbhmrexec.ExecOptions{MaxStdinBuffer: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != len("hello\n") {
+		t.Fatalf("expected Plan to leave a Stdin of unknown size unread, %d bytes left", r.Len())
+	}
+	if step := plan.Steps[0]; step.Op != "stdin" || step.Call != "buffer stdin (≤64 bytes)" {
+		t.Fatalf("expected a step that buffers stdin first, got:\n%s", plan)
+	}
+}
+
+func TestCmdExtExecInvalidLeavesStdin(t *testing.T) {
+	r := strings.NewReader("hello\n")
+	cmd := exec.Command("go-exec-test-nonexistent")
+	cmd.Stdin = io.MultiReader(r)
+	err := (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{MaxStdinBuffer: 64})
+	if !errors.Is(err, exec.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", exec.ErrNotFound, err)
+	}
+	if r.Len() != len("hello\n") {
+		t.Fatalf("expected Exec to leave Stdin unread, %d bytes left", r.Len())
+	}
+}
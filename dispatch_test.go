@@ -0,0 +1,20 @@
+//go:build unix || plan9
+
+package exec
+
+import "testing"
+
+func init() {
+	Register("test-dispatch", func() {})
+}
+
+func TestDispatchInternalOnly(t *testing.T) {
+	// The implicit dispatch when the package is initialized leaves the entrypoints
+	// registered with Register to Init. If it ran this one, the test binary would
+	// exit.
+	t.Setenv(entrypointEnv, "test-dispatch")
+	dispatch(false, true)
+	if internalEntrypoints["test-dispatch"] || !internalEntrypoints[stdinRelayEntrypoint] {
+		t.Fatalf("unexpected internal entrypoints %v", internalEntrypoints)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build unix || plan9
+
+// Package exec replaces the current process with a command, like execve(2), for the
+// commands of package os/exec. See [CmdExt.Exec] and [ExecProcess].
+//
+// # Entrypoints
+//
+// Some of what Exec does needs a helper process, or the current process re-executed
+// with a clean slate, which this package gets by running a copy of the current
+// executable for one of its entrypoints. A program can register entrypoints of its
+// own with [Register] and start them with [EntrypointCommand].
+//
+// When the package is initialized, it runs the entrypoint that the current process
+// was started for only if it is one of the package's own, so that importing the
+// package is enough for Exec to work. The entrypoints registered with Register only
+// run once main calls [Init], after the packages that they need are initialized.
+// In secure-execution mode, as for a set-user-ID program or one with file
+// capabilities (see AT_SECURE in getauxval(3)), the environment that names the
+// entrypoint comes from a less privileged caller, so no entrypoint runs unless main
+// calls Init.
+package exec
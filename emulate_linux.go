@@ -0,0 +1,26 @@
+package exec
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// dieFromSignal kills the current process with sig, as if sig had the default
+// disposition. The Go runtime doesn't offer that for every signal, so dieFromSignal
+// resets the disposition with rt_sigaction(2) itself.
+func dieFromSignal(sig syscall.Signal) {
+	// A zeroed struct sigaction is SIG_DFL with no flags and an empty mask on every
+	// architecture. It is larger than any of them need.
+	var act [8]uint64
+	_, _, _ = unix.RawSyscall6(unix.SYS_RT_SIGACTION, uintptr(sig), uintptr(unsafe.Pointer(&act)), 0, 8, 0, 0)
+	set := uint64(1) << (uint(sig) - 1)
+	_, _, _ = unix.RawSyscall6(unix.SYS_RT_SIGPROCMASK, unix.SIG_UNBLOCK, uintptr(unsafe.Pointer(&set)), 0, 8, 0, 0)
+	_ = unix.Kill(os.Getpid(), sig)
+
+	// The default disposition of some signals is to be ignored.
+	time.Sleep(100 * time.Millisecond)
+}
@@ -0,0 +1,23 @@
+//go:build unix && !linux
+
+package exec
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// dieFromSignal kills the current process with sig. The Go runtime lets a signal
+// that nobody is notified about kill the process with the same signal for the
+// signals whose default action is to terminate the process, and exits otherwise.
+func dieFromSignal(sig syscall.Signal) {
+	signal.Reset(sig)
+	_ = unix.Kill(os.Getpid(), sig)
+
+	// The default disposition of some signals is to be ignored.
+	time.Sleep(100 * time.Millisecond)
+}
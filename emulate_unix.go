@@ -0,0 +1,128 @@
+//go:build unix
+
+package exec
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExecOrRun is like [CmdExt.Exec], but when the current process can't be replaced it
+// falls back to [CmdExt.EmulateExec]. That is the case when Exec fails before
+// irreversibly changing the current process, for example because Stdout is a
+// [bytes.Buffer] or because the platform doesn't support a SysProcAttr field. It is
+// also the case when the current process is PID 1, which has to keep running to reap
+// orphaned processes.
+//
+// Like Exec, ExecOrRun only returns if it fails.
+func (c *CmdExt) ExecOrRun() error {
+	if os.Getpid() != 1 {
+		err := c.Exec()
+		var execErr *ExecError
+		if errors.Is(err, ErrExecInProgress) || (errors.As(err, &execErr) && execErr.Irreversible) {
+			return err
+		}
+	}
+	return c.EmulateExec()
+}
+
+// EmulateExec emulates [CmdExt.Exec] by starting the command as a child process
+// instead of replacing the current process with it.
+//
+// Like Exec, nil Stdin, Stdout and Stderr default to the ones of the current process.
+// While the child runs, every signal that the current process receives is forwarded
+// to it. If Stdin is the controlling terminal and the current process is in its
+// foreground process group, the child is put into a process group of its own and
+// made the foreground process group, so that signals generated by the terminal reach
+// only the child. When the child exits, the current process exits with the same
+// status. When the child is killed by a signal, the current process kills itself with
+// the same signal after restoring its default disposition.
+//
+// EmulateExec only returns if the command can't be started, in which case c is
+// unchanged.
+func (c *CmdExt) EmulateExec() error {
+	cmd := (*exec.Cmd)(c)
+	stdin, stdout, stderr, sys := cmd.Stdin, cmd.Stdout, cmd.Stderr, cmd.SysProcAttr
+	if cmd.Stdin == nil {
+		cmd.Stdin = os.Stdin
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+
+	foreground := takeForeground(cmd)
+
+	signals := make(chan os.Signal, 64)
+	signal.Notify(signals)
+	err := cmd.Start()
+	if err != nil {
+		signal.Stop(signals)
+		// Leave c as it was, so that the caller can still run it another way.
+		cmd.Stdin, cmd.Stdout, cmd.Stderr, cmd.SysProcAttr = stdin, stdout, stderr, sys
+		return err
+	}
+	go forwardSignals(signals, cmd.Process)
+	_ = cmd.Wait()
+	signal.Stop(signals)
+
+	if foreground {
+		// Take the terminal back. The current process is in a background process
+		// group now, so it would be sent SIGTTOU for that otherwise.
+		signal.Ignore(unix.SIGTTOU)
+		pgrp, _ := unix.Getpgid(0)
+		_ = tcsetpgrp(int(cmd.Stdin.(*os.File).Fd()), pgrp)
+	}
+
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if status.Signaled() {
+		dieFromSignal(status.Signal())
+		os.Exit(128 + int(status.Signal()))
+	}
+	os.Exit(status.ExitStatus())
+	panic("unreachable")
+}
+
+// takeForeground sets up cmd so that it is put into a process group of its own and
+// made the foreground process group when it starts, if its Stdin is the controlling
+// terminal and the current process is in the foreground process group. It reports
+// whether it did. SysProcAttr settings for process groups take precedence.
+func takeForeground(cmd *exec.Cmd) bool {
+	stdin, ok := cmd.Stdin.(*os.File)
+	if !ok || cmd.SysProcAttr != nil && (cmd.SysProcAttr.Setpgid || cmd.SysProcAttr.Foreground) {
+		return false
+	}
+	fg, err := tcgetpgrp(int(stdin.Fd()))
+	pgrp, _ := unix.Getpgid(0)
+	if err != nil || fg != pgrp {
+		return false
+	}
+	sys := &syscall.SysProcAttr{}
+	if cmd.SysProcAttr != nil {
+		*sys = *cmd.SysProcAttr
+	}
+	sys.Setpgid = true
+	sys.Foreground = true
+	sys.Ctty = 0
+	cmd.SysProcAttr = sys
+	return true
+}
+
+// forwardSignals sends each signal received from signals on to p.
+func forwardSignals(signals <-chan os.Signal, p *os.Process) {
+	for sig := range signals {
+		// SIGCHLD is about the child itself and SIGURG is used by the Go runtime to
+		// preempt goroutines.
+		if sig == unix.SIGCHLD || sig == unix.SIGURG {
+			continue
+		}
+		_ = p.Signal(sig)
+	}
+}
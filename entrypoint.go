@@ -0,0 +1,192 @@
+//go:build unix || plan9
+
+package exec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// The environment variables that tell a copy of the current executable which
+// entrypoint to run and where its payload is.
+const (
+	entrypointEnv        = "GO_EXEC_ENTRYPOINT"
+	entrypointPayloadEnv = "GO_EXEC_ENTRYPOINT_PAYLOAD"
+)
+
+var (
+	entrypointsMu sync.Mutex
+	// entrypoints holds the registered entrypoints by name, including the ones that
+	// this package uses itself.
+	entrypoints = map[string]func(){}
+	// internalEntrypoints holds the names of the entrypoints that this package uses
+	// itself, which init dispatches to.
+	internalEntrypoints = map[string]bool{}
+	// entrypointPayload is the file that holds the payload of the running
+	// entrypoint, if any.
+	entrypointPayload *os.File
+)
+
+func init() {
+	// Run the entrypoints of this package even if main doesn't call Init, but only
+	// those, so that a program doesn't run its own entrypoints before the packages
+	// that they need are initialized. In secure-execution mode the environment
+	// comes from a less privileged caller, so nothing runs without Init.
+	if !secureMode() {
+		dispatch(false, true)
+	}
+}
+
+// registerEntrypoint registers one of the entrypoints of this package. It is called
+// to initialize a package-level variable, so that the entrypoint is registered
+// before init dispatches to it, whichever file it is in.
+func registerEntrypoint(name string, fn func()) struct{} {
+	Register(name, fn)
+	entrypointsMu.Lock()
+	defer entrypointsMu.Unlock()
+	internalEntrypoints[name] = true
+	return struct{}{}
+}
+
+// Register registers fn as the entrypoint called name, which [EntrypointCommand]
+// runs in a new process. It panics if name is empty or already registered.
+//
+// Register is usually called from an init function, so that the entrypoint is
+// registered by the time that main calls [Init].
+func Register(name string, fn func()) {
+	entrypointsMu.Lock()
+	defer entrypointsMu.Unlock()
+	if name == "" {
+		panic("exec: Register with an empty name")
+	}
+	if _, ok := entrypoints[name]; ok {
+		panic("exec: Register called twice for " + strconv.Quote(name))
+	}
+	entrypoints[name] = fn
+}
+
+// Init runs the entrypoint that the current process was started for by
+// [EntrypointCommand], if any, and then exits with status 0 unless the entrypoint
+// exits by itself. If the current process wasn't started for an entrypoint, Init
+// returns.
+//
+// Init must be called at the top of main, or of TestMain in tests, before anything
+// that the entrypoint shouldn't do. It exits with status 2 if the entrypoint isn't
+// registered. Only Init runs the entrypoints registered with [Register]; see the
+// package documentation for the ones that this package runs by itself.
+func Init() {
+	dispatch(true, false)
+}
+
+// dispatch runs the entrypoint named in the environment, if any, or, if
+// internalOnly is set, only if it is one of the entrypoints of this package. If the
+// entrypoint isn't registered, dispatch exits the process when strict is set and
+// returns otherwise.
+func dispatch(strict bool, internalOnly bool) {
+	name, ok := os.LookupEnv(entrypointEnv)
+	if !ok {
+		return
+	}
+	entrypointsMu.Lock()
+	fn, ok := entrypoints[name]
+	internal := internalEntrypoints[name]
+	entrypointsMu.Unlock()
+	if internalOnly && !internal {
+		return
+	}
+	if !ok {
+		if strict {
+			fmt.Fprintf(os.Stderr, "exec: entrypoint %q is not registered\n", name)
+			os.Exit(2)
+		}
+		return
+	}
+
+	// Don't pass the entrypoint on to the processes that it starts.
+	if fd, err := strconv.Atoi(os.Getenv(entrypointPayloadEnv)); err == nil {
+		entrypointPayload = os.NewFile(uintptr(fd), "payload")
+	}
+	_ = os.Unsetenv(entrypointEnv)
+	_ = os.Unsetenv(entrypointPayloadEnv)
+
+	fn()
+	os.Exit(0)
+}
+
+// EntrypointCommand returns a command that runs the entrypoint called name in a
+// copy of the current executable, with args as its command-line arguments after
+// the name. It can be run with [CmdExt.Exec] to replace the current process, or
+// started as a child with [os/exec.Cmd.Start].
+//
+// If payload isn't nil, it is encoded as JSON and passed to the entrypoint in the
+// first of ExtraFiles, where [EntrypointPayload] decodes it. Further ExtraFiles must
+// be appended after it.
+//
+// On Linux, the copy of the current executable is /proc/self/exe, so it is the same
+// even if the executable has been replaced since the current process started.
+func EntrypointCommand(name string, payload any, args ...string) (*CmdExt, error) {
+	path := "/proc/self/exe"
+	if runtime.GOOS != "linux" {
+		var err error
+		path, err = os.Executable()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := &exec.Cmd{
+		Path: path,
+		Args: append([]string{name}, args...),
+		Env:  append(os.Environ(), entrypointEnv+"="+name),
+	}
+	if payload != nil {
+		f, err := payloadFile(payload)
+		if err != nil {
+			return nil, err
+		}
+		cmd.ExtraFiles = []*os.File{f}
+		cmd.Env = append(cmd.Env, entrypointPayloadEnv+"=3")
+	}
+	return (*CmdExt)(cmd), nil
+}
+
+// payloadFile returns a new anonymous file, rewound and sealed, that holds payload
+// encoded as JSON.
+func payloadFile(payload any) (*os.File, error) {
+	f, err := memFile("payload")
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewEncoder(f).Encode(payload)
+	if err == nil {
+		err = sealFile(f)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// EntrypointPayload decodes the payload passed to the running entrypoint by
+// [EntrypointCommand] into v, like [encoding/json.Unmarshal]. It can only be called
+// once.
+func EntrypointPayload(v any) error {
+	f := entrypointPayload
+	if f == nil {
+		return errors.New("exec: no entrypoint payload")
+	}
+	entrypointPayload = nil
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
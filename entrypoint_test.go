@@ -0,0 +1,84 @@
+//go:build unix || plan9
+
+package exec_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	jcbhmrexec "github.com/jcbhmr/go-exec"
+)
+
+type greeting struct {
+	Name string
+}
+
+func init() {
+	jcbhmrexec.Register("test-greet", func() {
+		var g greeting
+		if err := jcbhmrexec.EntrypointPayload(&g); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if _, ok := os.LookupEnv("GO_EXEC_ENTRYPOINT"); ok {
+			fmt.Fprintln(os.Stderr, "GO_EXEC_ENTRYPOINT is still set")
+			os.Exit(1)
+		}
+		fmt.Printf("hello %s from %d, args %q\n", g.Name, os.Getpid(), os.Args[1:])
+	})
+	helpers["exec-entrypoint"] = func(args []string) {
+		cmd, err := jcbhmrexec.EntrypointCommand("test-greet", greeting{Name: args[0]}, "a", "b")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d\n", os.Getpid())
+		err = cmd.Exec()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func TestEntrypointCommand(t *testing.T) {
+	cmd, err := jcbhmrexec.EntrypointCommand("test-greet", greeting{Name: "child"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := (*exec.Cmd)(cmd).Output()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if !strings.HasPrefix(string(out), "hello child from ") {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestEntrypointCommandExec(t *testing.T) {
+	out, err := helperCommand(t, "exec-entrypoint", "exec").Output()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	pid, rest, _ := strings.Cut(string(out), "\n")
+	if _, err := strconv.Atoi(pid); err != nil {
+		t.Fatalf("unexpected output %q", out)
+	}
+	want := fmt.Sprintf("hello exec from %s, args [\"a\" \"b\"]\n", pid)
+	if rest != want {
+		t.Fatalf("expected %q, got %q", want, rest)
+	}
+}
+
+func TestEntrypointNotRegistered(t *testing.T) {
+	cmd, err := jcbhmrexec.EntrypointCommand("test-not-registered", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := (*exec.Cmd)(cmd).CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 2 {
+		t.Fatalf("expected exit status 2, got %v\n%s", err, out)
+	}
+}
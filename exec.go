@@ -3,24 +3,241 @@
 package exec
 
 import (
+	"errors"
 	"os"
 	"runtime"
+	"slices"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 // ExecProcess is similar to [os.StartProcess]. Instead of starting
 // the process, it replaces the current process with the new one using [syscall.Exec].
 //
 // ExecProcess always returns a non-nil error.
+//
+// Only one ExecProcess or [CmdExt.Exec] call can be in progress at a time. While one
+// is, the others fail with [ErrExecInProgress]. ExecProcess also holds
+// [syscall.ForkLock] so that processes started concurrently by [os.StartProcess] or
+// [os/exec] don't inherit the file descriptors it sets up for the new program.
+//
+// On Unix, when attr.Sys sets Chroot, the new program starts in the new root
+// directory unless attr.Dir names another directory in it. A relative attr.Dir is
+// relative to the new root directory, and a relative name to the working directory
+// in it, rather than to the current working directory. ExecProcess fails before
+// changing the root directory if there is no file at name in it.
+//
+// On Linux, the kernel doesn't let a multi-threaded process enter a new user
+// namespace, so when attr.Sys has CLONE_NEWUSER, or [ExecOptions.Namespaces] has
+// namespaces that a thread can't enter alone, ExecProcess re-executes the current
+// executable, which enters it from a cgo constructor while it is still single
+// threaded. The constructor is in package [github.com/jcbhmr/go-exec/nsenter], and
+// ExecProcess fails in programs that don't import it or are built without cgo. Once
+// the current executable has been re-executed, a failing step prints an error and
+// exits with status 126 instead of returning.
 func ExecProcess(name string, argv []string, attr *os.ProcAttr) error {
-	sysattr := (*procAttrExt)(attr).lower()
+	return ExecProcessWith(name, argv, attr, nil)
+}
+
+// ExecOptions configures the behavior of [ExecProcessWith] and [CmdExt.ExecWith] that
+// has no equivalent in [os.ProcAttr] or [os/exec.Cmd]. The zero value, like a nil
+// *ExecOptions, gives the behavior of [ExecProcess] and [CmdExt.Exec].
+type ExecOptions struct {
+	// Strict makes Exec fail with an [*UnsupportedSysProcAttrError], before changing
+	// anything, if SysProcAttr sets a field that Exec does not honor on the current
+	// platform. See [SupportedSysProcAttrFields].
+	Strict bool
+
+	// NullStdio makes a nil Stdin, Stdout or Stderr of the [os/exec.Cmd] refer to the
+	// null device, like it does for [os/exec.Cmd.Run]. By default, [CmdExt.Exec] lets
+	// the new program inherit the standard input, output or error of the current
+	// process instead, like a shell's exec builtin.
+	NullStdio bool
+
+	// MaxStdinBuffer is the number of bytes that [CmdExt.Exec] may copy into an
+	// anonymous file from a Stdin that has no file descriptor and no known size. Exec
+	// fails if there is more to read than that. If MaxStdinBuffer is zero, such a
+	// Stdin is an error.
+	//
+	// A Stdin of known size, like a [*bytes.Reader], [*strings.Reader] or
+	// [*bytes.Buffer], is always copied, regardless of MaxStdinBuffer. If Exec fails
+	// after reading from Stdin, it seeks back if Stdin is an [io.Seeker], but a
+	// Stdin that isn't one loses the data that was read.
+	MaxStdinBuffer int64
+
+	// Files maps file descriptor numbers of the new program to files of the current
+	// process, on top of the files of the [os.ProcAttr], or the Stdin, Stdout, Stderr
+	// and ExtraFiles of the [os/exec.Cmd]. An entry replaces the file at the same
+	// position, or adds one after them, in which case the file descriptors in between
+	// are closed. A nil file closes the file descriptor.
+	Files map[int]*os.File
+
+	// Fds is like Files for file descriptors of the current process that have no
+	// [*os.File], with -1 closing the file descriptor. A file descriptor number may
+	// not be in both Files and Fds.
+	Fds map[int]int
+
+	// CloseOtherFds sets the close-on-exec flag of every file descriptor of the
+	// current process other than the files of the new program, so that none leak into
+	// it. Go sets that flag on the file descriptors that it opens, but cgo libraries,
+	// raw system calls and the parent of the current process may not have. See
+	// [InheritableFds]. On Plan 9, other file descriptors are always closed.
+	CloseOtherFds bool
+
+	// PidInit makes a minimal init process, rather than the new program, the first
+	// process of the PID namespace that SysProcAttr asks for with CLONE_NEWPID. The
+	// new program can't be that process, because unshare(2) only puts the children
+	// of the current process into the new PID namespace. So the current process is
+	// replaced by one that starts the init as its child and otherwise behaves like
+	// [CmdExt.EmulateExec], and the init runs the new program as its own child. The
+	// init forwards signals to it, reaps the orphaned processes of the namespace and
+	// exits with its exit status, or 128 plus the number of the signal that killed
+	// it. If SysProcAttr asks for a new mount namespace too, the init mounts a fresh
+	// /proc for the PID namespace first, unless PivotRoot is set: then Mounts need to
+	// include a proc file system below PivotRoot. PidInit has no effect on other
+	// platforms than Linux.
+	PidInit bool
+
+	// Mounts set up the new mount namespace that SysProcAttr asks for with
+	// CLONE_NEWNS, in order, after the namespaces are created and before the
+	// credentials change. Relative paths are relative to the current working
+	// directory rather than to Dir. Exec fails if Mounts or PivotRoot are set but
+	// there is no new mount namespace. Mounts are only supported on Linux.
+	Mounts []Mount
+
+	// PivotRoot is a directory, typically prepared by Mounts, that pivot_root(2)
+	// makes the root directory after Mounts. The old root directory is unmounted, so
+	// that nothing outside PivotRoot remains reachable. Chroot and Dir are relative
+	// to the new root directory. PivotRoot is only supported on Linux.
+	PivotRoot string
+
+	// Namespaces are existing namespaces that the new program enters, in order,
+	// after the process group changes and before the namespaces that SysProcAttr
+	// asks for are created. Like nsenter(1), Exec enters a user namespace after the
+	// others if it can, which a privileged caller needs, and before them otherwise,
+	// which an unprivileged one needs.
+	//
+	// Network, UTS, IPC and cgroup namespaces are entered by the calling thread, and
+	// left again if Exec fails. The other types of namespaces can only be entered by
+	// a single-threaded process, so Exec re-executes the current executable, like it
+	// does for a new user namespace, and fails without package nsenter. Only
+	// children enter a PID namespace, so for one, the re-executed process stays
+	// behind as the parent of the new program, like nsenter --fork. It forwards
+	// signals to it and exits with its exit status. Namespaces are only supported on
+	// Linux.
+	Namespaces []Namespace
+
+	// LoopbackUp brings up the loopback interface of the new network namespace that
+	// SysProcAttr asks for with CLONE_NEWNET, whose interfaces are all down at first,
+	// so that the new program can reach 127.0.0.1 and ::1. Exec sends the netlink
+	// request itself rather than running ip(8). LoopbackUp is only supported on Linux.
+	LoopbackUp bool
+
+	// Hostname and Domainname, if they aren't empty, are the host name and NIS
+	// domain name of the new UTS namespace that SysProcAttr asks for with
+	// CLONE_NEWUTS. They are only supported on Linux.
+	Hostname   string
+	Domainname string
+
+	// MonotonicOffset and BoottimeOffset are added to CLOCK_MONOTONIC and
+	// CLOCK_BOOTTIME in the new time namespace that SysProcAttr asks for with
+	// CLONE_NEWTIME, which the new program enters when it starts. Only the main
+	// thread of a process can set them, so Exec re-executes the current executable,
+	// like it does for a new user namespace, and fails without package nsenter.
+	// They are only supported on Linux.
+	MonotonicOffset time.Duration
+	BoottimeOffset  time.Duration
+}
+
+// ExecProcessWith is like [ExecProcess] but takes additional options.
+func ExecProcessWith(name string, argv []string, attr *os.ProcAttr, opts *ExecOptions) error {
+	if !execInProgress.CompareAndSwap(false, true) {
+		return ErrExecInProgress
+	}
+	defer execInProgress.Store(false)
+	return execProcessWith(name, argv, attr, opts)
+}
+
+// execProcessWith is ExecProcessWith for a caller that has already set
+// execInProgress.
+func execProcessWith(name string, argv []string, attr *os.ProcAttr, opts *ExecOptions) error {
+	s := newExecState(name, argv, opts)
+	return execProcessAttr(s, name, argv, attr)
+}
+
+func execProcessAttr(s *execState, name string, argv []string, attr *os.ProcAttr) error {
+	sysattr, err := s.lower(attr)
+	if err != nil {
+		return err
+	}
+
+	if s.opts.Strict && sysattr != nil && sysattr.Sys != nil {
+		err := checkSysProcAttr(sysattr.Sys)
+		if err != nil {
+			return err
+		}
+	}
+
+	if runtime.GOOS != "linux" && (len(s.opts.Mounts) > 0 || s.opts.PivotRoot != "") {
+		return errors.New("exec: Mounts and PivotRoot are only supported on Linux")
+	}
+	if runtime.GOOS != "linux" && len(s.opts.Namespaces) > 0 {
+		return errors.New("exec: Namespaces are only supported on Linux")
+	}
+	if runtime.GOOS != "linux" && (s.opts.LoopbackUp || s.opts.Hostname != "" || s.opts.Domainname != "" || s.opts.MonotonicOffset != 0 || s.opts.BoottimeOffset != 0) {
+		return errors.New("exec: LoopbackUp, Hostname, Domainname and time offsets are only supported on Linux")
+	}
+
+	if !s.dryRun {
+		if execPreflight != nil {
+			err := execPreflight(s, sysattr)
+			if err != nil {
+				return err
+			}
+		}
+		syscall.ForkLock.Lock()
+		defer syscall.ForkLock.Unlock()
+	}
 
 	// Platform-specific
-	err := execProcess(name, argv, sysattr)
+	err = execProcess(s, name, argv, sysattr)
+	if err != nil {
+		s.rollback()
+	}
 	runtime.KeepAlive(attr.Files)
+	runtime.KeepAlive(s.opts.Files)
 	return err
 }
 
+// lower lowers attr and applies the Files and Fds of s.opts to the result.
+func (s *execState) lower(attr *os.ProcAttr) (*syscall.ProcAttr, error) {
+	sysattr := (*procAttrExt)(attr).lower()
+	if sysattr == nil {
+		if len(s.opts.Files) == 0 && len(s.opts.Fds) == 0 {
+			return nil, nil
+		}
+		sysattr = &syscall.ProcAttr{}
+	}
+	files, err := s.mapFiles(sysattr.Files)
+	if err != nil {
+		return nil, err
+	}
+	sysattr.Files = files
+	return sysattr, nil
+}
+
+// ErrExecInProgress is returned by [ExecProcess] and [CmdExt.Exec] when another call
+// to either of them is already replacing the current process.
+var ErrExecInProgress = errors.New("exec: another Exec is in progress")
+
+var execInProgress atomic.Bool
+
+// execPreflight, if set, checks that the platform can carry out attr before Exec
+// takes syscall.ForkLock, so that it may start processes itself. Set in
+// reexec_linux.go.
+var execPreflight func(s *execState, attr *syscall.ProcAttr) error
+
 type procAttrExt os.ProcAttr
 
 func (p *procAttrExt) lower() *syscall.ProcAttr {
@@ -41,3 +258,93 @@ func (p *procAttrExt) lower() *syscall.ProcAttr {
 
 	return sysattr
 }
+
+// ExecError is returned by [ExecProcess] and [CmdExt.Exec] when one of the steps
+// leading up to and including execve(2) fails.
+//
+// Op names the failed step. It is one of "cgroup", "setsid", "setpgid", "ioctl",
+// "setns", "unshare", "netlink", "sethostname", "setdomainname", "mount", "mknod",
+// "mkdir", "symlink", "pivot_root", "chroot", "setgroups", "setgid", "setuid",
+// "capset", "prctl", "chdir", "jail", "procctl", "ptrace", "dup", "close" or
+// "execve".
+// Not every step exists on every platform.
+type ExecError struct {
+	Op   string
+	Path string
+	Args []string
+	Err  error
+
+	// Irreversible reports whether an earlier step had already changed the state of
+	// the calling process (its session, namespaces, credentials, working directory or
+	// file descriptors) in a way that could not be rolled back when Op failed.
+	//
+	// On Linux, the process group, foreground process group, working directory, file
+	// descriptors and the namespaces that the calling thread entered for
+	// [ExecOptions.Namespaces] are restored when a later step fails, so changing them
+	// alone doesn't make a failure irreversible. The umask is never changed.
+	Irreversible bool
+}
+
+func (e *ExecError) Error() string {
+	return "exec " + e.Path + ": " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *ExecError) Unwrap() error { return e.Err }
+
+// execState tracks a single call to execProcess so that a failing step can be
+// reported as an [*ExecError] and the reversible steps before it rolled back, or,
+// when dryRun is set, so that the steps are recorded instead of run.
+type execState struct {
+	path         string
+	argv         []string
+	opts         *ExecOptions
+	irreversible bool
+	undo         []func()
+
+	dryRun bool
+	steps  []ExecStep
+}
+
+func newExecState(path string, argv []string, opts *ExecOptions) *execState {
+	if opts == nil {
+		opts = &ExecOptions{}
+	}
+	return &execState{path: path, argv: argv, opts: opts}
+}
+
+// do runs the step named op, which performs call. If fn fails, do returns an
+// [*ExecError] describing it. Otherwise the calling process counts as irreversibly
+// changed from then on.
+func (s *execState) do(op string, call string, fn func() error) error {
+	return s.doReversible(op, call, func() (func(), error) {
+		return nil, fn()
+	})
+}
+
+// doReversible is like do for a step that can be undone. If fn succeeds, it returns
+// a function that undoes it, which rollback calls. If that function is nil, the
+// step counts as irreversible like with do.
+func (s *execState) doReversible(op string, call string, fn func() (undo func(), err error)) error {
+	if s.dryRun {
+		s.steps = append(s.steps, ExecStep{Op: op, Call: call})
+		return nil
+	}
+	undo, err := fn()
+	if err != nil {
+		return &ExecError{Op: op, Path: s.path, Args: s.argv, Err: err, Irreversible: s.irreversible}
+	}
+	if undo != nil {
+		s.undo = append(s.undo, undo)
+	} else {
+		s.irreversible = true
+	}
+	return nil
+}
+
+// rollback undoes the reversible steps that succeeded, most recent first.
+func (s *execState) rollback() {
+	for _, undo := range slices.Backward(s.undo) {
+		undo()
+	}
+	s.undo = nil
+}
@@ -3,17 +3,18 @@
 package exec
 
 import (
+	"fmt"
 	"os"
 	"runtime"
-	"sync"
 	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
-var forked sync.Mutex
+// unsupportedSysProcAttrFields are the SysProcAttr fields that execProcessUnix does not honor.
+var unsupportedSysProcAttrFields []string
 
-func execProcessUnix(argv0 string, argv []string, attr *syscall.ProcAttr, sys *unix.SysProcAttr) (err error) {
+func execProcessUnix(s *execState, argv0 string, argv []string, attr *syscall.ProcAttr, sys *unix.SysProcAttr) (err error) {
 	fd := make([]int, len(attr.Files))
 	nextfd := len(attr.Files)
 	for i, ufd := range attr.Files {
@@ -24,25 +25,30 @@ func execProcessUnix(argv0 string, argv []string, attr *syscall.ProcAttr, sys *u
 	}
 	nextfd++
 
-	forked.Lock()
-	defer forked.Unlock()
-
 	if sys.Ptrace {
-		_, err = ptrace(unix.PTRACE_TRACEME, 0, 0, 0)
+		err = s.do("ptrace", "ptrace(PTRACE_TRACEME)", func() error {
+			_, err := ptrace(unix.PTRACE_TRACEME, 0, 0, 0)
+			return err
+		})
 		if err != nil {
 			return err
 		}
 	}
 
 	if sys.Setsid {
-		_, err = unix.Setsid()
+		err = s.do("setsid", "setsid()", func() error {
+			_, err := unix.Setsid()
+			return err
+		})
 		if err != nil {
 			return err
 		}
 	}
 
 	if sys.Setpgid || sys.Foreground {
-		err = unix.Setpgid(0, sys.Pgid)
+		err = s.do("setpgid", fmt.Sprintf("setpgid(0, %d)", sys.Pgid), func() error {
+			return unix.Setpgid(0, sys.Pgid)
+		})
 		if err != nil {
 			return err
 		}
@@ -53,14 +59,16 @@ func execProcessUnix(argv0 string, argv []string, attr *syscall.ProcAttr, sys *u
 		if pgrp == 0 {
 			pgrp = os.Getpid()
 		}
-		err = unix.IoctlSetPointerInt(int(attr.Files[0]), unix.TIOCSPGRP, pgrp)
+		err = s.do("ioctl", fmt.Sprintf("ioctl(%d, TIOCSPGRP, %d)", attr.Files[0], pgrp), func() error {
+			return unix.IoctlSetPointerInt(int(attr.Files[0]), unix.TIOCSPGRP, pgrp)
+		})
 		if err != nil {
 			return err
 		}
 	}
 
 	if sys.Chroot != "" {
-		err = unix.Chroot(sys.Chroot)
+		err = chroot(s, sys.Chroot, argv0)
 		if err != nil {
 			return err
 		}
@@ -76,23 +84,31 @@ func execProcessUnix(argv0 string, argv []string, attr *syscall.ProcAttr, sys *u
 			}
 		}
 		if !cred.NoSetGroups {
-			err = unix.Setgroups(groups)
+			err = s.do("setgroups", fmt.Sprintf("setgroups(%v)", groups), func() error {
+				return unix.Setgroups(groups)
+			})
 			if err != nil {
 				return err
 			}
 		}
-		err = unix.Setgid(int(cred.Gid))
+		err = s.do("setgid", fmt.Sprintf("setgid(%d)", cred.Gid), func() error {
+			return unix.Setgid(int(cred.Gid))
+		})
 		if err != nil {
 			return err
 		}
-		err = unix.Setuid(int(cred.Uid))
+		err = s.do("setuid", fmt.Sprintf("setuid(%d)", cred.Uid), func() error {
+			return unix.Setuid(int(cred.Uid))
+		})
 		if err != nil {
 			return err
 		}
 	}
 
 	if attr.Dir != "" {
-		err = os.Chdir(attr.Dir)
+		err = s.do("chdir", fmt.Sprintf("chdir(%q)", attr.Dir), func() error {
+			return os.Chdir(attr.Dir)
+		})
 		if err != nil {
 			return err
 		}
@@ -100,15 +116,18 @@ func execProcessUnix(argv0 string, argv []string, attr *syscall.ProcAttr, sys *u
 
 	for i, f := range fd {
 		if f >= 0 && f < i {
-			if runtime.GOOS == "openbsd" {
-				err = openbsdlibcDup3(f, nextfd, unix.O_CLOEXEC)
-			} else {
-				err = unix.Dup2(f, nextfd)
-				if err != nil {
-					return err
+			err = s.do("dup", fmt.Sprintf("dup(%d, %d)", f, nextfd), func() error {
+				if runtime.GOOS == "openbsd" {
+					return openbsdlibcDup3(f, nextfd, unix.O_CLOEXEC)
+				} else {
+					err := unix.Dup2(f, nextfd)
+					if err != nil {
+						return err
+					}
+					unix.CloseOnExec(nextfd)
+					return nil
 				}
-				unix.CloseOnExec(nextfd)
-			}
+			})
 			if err != nil {
 				return err
 			}
@@ -119,41 +138,63 @@ func execProcessUnix(argv0 string, argv []string, attr *syscall.ProcAttr, sys *u
 
 	for i, f := range fd {
 		if f == -1 {
-			_ = unix.Close(i)
+			_ = s.do("close", fmt.Sprintf("close(%d)", i), func() error {
+				return unix.Close(i)
+			})
 			continue
 		}
 		if f == i {
-			_, err = unix.FcntlInt(uintptr(f), unix.F_SETFD, 0)
+			err = s.do("dup", fmt.Sprintf("fcntl(%d, F_SETFD, 0)", f), func() error {
+				_, err := unix.FcntlInt(uintptr(f), unix.F_SETFD, 0)
+				return err
+			})
 			if err != nil {
 				return err
 			}
 			continue
 		}
-		err = unix.Dup2(f, i)
+		err = s.do("dup", fmt.Sprintf("dup2(%d, %d)", f, i), func() error {
+			return unix.Dup2(f, i)
+		})
 		if err != nil {
 			return err
 		}
 	}
 
 	for i := len(fd); i < 3; i++ {
-		_ = unix.Close(i)
+		_ = s.do("close", fmt.Sprintf("close(%d)", i), func() error {
+			return unix.Close(i)
+		})
+	}
+
+	if s.opts.CloseOtherFds {
+		err = closeOtherFds(s, len(fd))
+		if err != nil {
+			return err
+		}
 	}
 
 	if sys.Noctty {
-		err = unix.IoctlSetInt(0, unix.TIOCNOTTY, 0)
+		err = s.do("ioctl", "ioctl(0, TIOCNOTTY)", func() error {
+			return unix.IoctlSetInt(0, unix.TIOCNOTTY, 0)
+		})
 		if err != nil {
 			return err
 		}
 	}
 
 	if sys.Setctty {
-		err = unix.IoctlSetInt(sys.Ctty, unix.TIOCSCTTY, 0)
+		err = s.do("ioctl", fmt.Sprintf("ioctl(%d, TIOCSCTTY)", sys.Ctty), func() error {
+			return unix.IoctlSetInt(sys.Ctty, unix.TIOCSCTTY, 0)
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	return unix.Exec(argv0, argv, attr.Env)
+	return s.do("execve", fmt.Sprintf("execve(%q, %q)", argv0, argv), func() error {
+		return execve(argv0, argv, attr.Env)
+	})
 }
 
 // Set in exec_openbsdlibc.go
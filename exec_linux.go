@@ -1,31 +1,77 @@
 package exec
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"runtime"
 	"strconv"
-	"sync"
 	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
-var forked sync.Mutex
+// unsupportedSysProcAttrFields are the SysProcAttr fields that execProcessUnix does not honor.
+var unsupportedSysProcAttrFields = []string{"PidFD"}
 
-func execProcessUnix(argv0 string, argv []string, attr *syscall.ProcAttr, sys *unix.SysProcAttr) (err error) {
-	var uidmap []byte
-	if sys.UidMappings != nil {
-		uidmap = formatIDMappings(sys.UidMappings)
+func execProcessUnix(s *execState, argv0 string, argv []string, attr *syscall.ProcAttr, sys *unix.SysProcAttr) error {
+	if s.dryRun {
+		return execProcessThread(s, argv0, argv, attr, sys)
 	}
 
-	var setgroups []byte
-	var gidmap []byte
-	if sys.GidMappings != nil {
-		if sys.GidMappingsEnableSetgroups {
-			setgroups = []byte("allow\x00")
-		} else {
-			setgroups = []byte("deny\x00")
+	// Namespaces, capabilities and some prctl(2) settings belong to the calling
+	// thread rather than the process, so everything up to execve(2) has to run on the
+	// same thread, and so does the rollback. That is a thread of its own, which stays
+	// locked if Exec fails, so that the runtime throws it away rather than let the
+	// caller or another goroutine run on it.
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		err := execProcessThread(s, argv0, argv, attr, sys)
+		if err != nil {
+			s.rollback()
 		}
-		gidmap = formatIDMappings(sys.GidMappings)
+		errc <- err
+	}()
+	return <-errc
+}
+
+// execProcessThread carries out execProcessUnix on the calling thread, which is
+// locked to the calling goroutine.
+func execProcessThread(s *execState, argv0 string, argv []string, attr *syscall.ProcAttr, sys *unix.SysProcAttr) (err error) {
+	if sys.PidFD != nil {
+		return errors.New("exec: PidFD set in SysProcAttr has no equivalent for Exec")
+	}
+
+	// Exec keeps the current process, so the namespaces that Start would create with
+	// clone(2) have to be created with unshare(2) instead.
+	unshareflags := sys.Unshareflags
+	if sys.Cloneflags != 0 {
+		if sys.Cloneflags&^cloneNamespaceFlags != 0 {
+			return fmt.Errorf("exec: Cloneflags %#x set in SysProcAttr have no equivalent for Exec", sys.Cloneflags&^cloneNamespaceFlags)
+		}
+		unshareflags |= sys.Cloneflags
+	}
+	if (len(s.opts.Mounts) > 0 || s.opts.PivotRoot != "") && unshareflags&unix.CLONE_NEWNS == 0 {
+		return errors.New("exec: Mounts and PivotRoot need CLONE_NEWNS in SysProcAttr")
+	}
+	if s.opts.LoopbackUp && unshareflags&unix.CLONE_NEWNET == 0 {
+		return errors.New("exec: LoopbackUp needs CLONE_NEWNET in SysProcAttr")
+	}
+	if (s.opts.Hostname != "" || s.opts.Domainname != "") && unshareflags&unix.CLONE_NEWUTS == 0 {
+		return errors.New("exec: Hostname and Domainname need CLONE_NEWUTS in SysProcAttr")
+	}
+	if hasTimeOffsets(s.opts) && unshareflags&unix.CLONE_NEWTIME == 0 {
+		return errors.New("exec: MonotonicOffset and BoottimeOffset need CLONE_NEWTIME in SysProcAttr")
+	}
+
+	var nsFiles []nsFile
+	if len(s.opts.Namespaces) > 0 {
+		nsFiles, err = openNamespaces(s.opts.Namespaces)
+		if err != nil {
+			return err
+		}
+		defer closeNamespaces(nsFiles)
 	}
 
 	fd := make([]int, len(attr.Files))
@@ -38,25 +84,47 @@ func execProcessUnix(argv0 string, argv []string, attr *syscall.ProcAttr, sys *u
 	}
 	nextfd++
 
-	forked.Lock()
-	defer forked.Unlock()
+	if sys.UseCgroupFD {
+		pid := os.Getpid()
+		err = s.do("cgroup", fmt.Sprintf("write(%d/cgroup.procs, %d)", sys.CgroupFD, pid), func() error {
+			return writeCgroupProcs(sys.CgroupFD, pid)
+		})
+		if err != nil {
+			return err
+		}
+	}
 
 	if len(sys.AmbientCaps) > 0 {
-		err = unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0)
+		err = s.do("prctl", "prctl(PR_SET_KEEPCAPS, 1)", func() error {
+			return unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0)
+		})
 		if err != nil {
 			return err
 		}
 	}
 
 	if sys.Setsid {
-		_, err = unix.Setsid()
+		err = s.do("setsid", "setsid()", func() error {
+			_, err := unix.Setsid()
+			return err
+		})
 		if err != nil {
 			return err
 		}
 	}
 
 	if sys.Setpgid || sys.Foreground {
-		err = unix.Setpgid(0, sys.Pgid)
+		err = s.doReversible("setpgid", fmt.Sprintf("setpgid(0, %d)", sys.Pgid), func() (func(), error) {
+			pgid, err := unix.Getpgid(0)
+			if err != nil {
+				return nil, err
+			}
+			err = unix.Setpgid(0, sys.Pgid)
+			if err != nil {
+				return nil, err
+			}
+			return func() { _ = unix.Setpgid(0, pgid) }, nil
+		})
 		if err != nil {
 			return err
 		}
@@ -67,47 +135,108 @@ func execProcessUnix(argv0 string, argv []string, attr *syscall.ProcAttr, sys *u
 		if pgrp == 0 {
 			pgrp = os.Getpid()
 		}
-		err = unix.IoctlSetPointerInt(sys.Ctty, unix.TIOCSPGRP, pgrp)
+		err = s.doReversible("ioctl", fmt.Sprintf("ioctl(%d, TIOCSPGRP, %d)", sys.Ctty, pgrp), func() (func(), error) {
+			fg, err := unix.IoctlGetInt(sys.Ctty, unix.TIOCGPGRP)
+			if err != nil {
+				return nil, err
+			}
+			err = unix.IoctlSetPointerInt(sys.Ctty, unix.TIOCSPGRP, pgrp)
+			if err != nil {
+				return nil, err
+			}
+			return func() { _ = unix.IoctlSetPointerInt(sys.Ctty, unix.TIOCSPGRP, fg) }, nil
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	if sys.Unshareflags != 0 {
-		err = unix.Unshare(int(sys.Unshareflags))
+	if nsFiles != nil {
+		// The rest happens in the namespaces, in another process image.
+		if !threadNamespaces(nsFiles) {
+			return execSetns(s, argv0, argv, attr, sys, unshareflags, nsFiles)
+		}
+		err = enterNamespaces(s, nsFiles)
 		if err != nil {
 			return err
 		}
+	}
 
-		if sys.Unshareflags&unix.CLONE_NEWUSER != 0 && sys.GidMappings != nil {
-			err = os.WriteFile("/proc/self/setgroups", setgroups, 0o600)
-			if err != nil {
-				return err
-			}
+	// The rest happens in the new user or time namespace, in another process image.
+	if unshareflags&unix.CLONE_NEWUSER != 0 || hasTimeOffsets(s.opts) {
+		return execUnshare(s, argv0, argv, attr, sys, unshareflags)
+	}
 
-			err = os.WriteFile("/proc/self/gid_map", gidmap, 0o600)
-			if err != nil {
-				return err
-			}
+	// The init is cloned into the new PID namespace instead. A process that has
+	// unshared its PID namespace can't create threads anymore.
+	pidInit := unshareflags&unix.CLONE_NEWPID != 0 && s.opts.PidInit
+	if pidInit {
+		unshareflags &^= unix.CLONE_NEWPID
+	}
+
+	if unshareflags != 0 {
+		err = s.do("unshare", fmt.Sprintf("unshare(%#x)", unshareflags), func() error {
+			return unix.Unshare(int(unshareflags))
+		})
+		if err != nil {
+			return err
 		}
 
-		if sys.Unshareflags&unix.CLONE_NEWUSER != 0 && sys.UidMappings != nil {
-			err = os.WriteFile("/proc/self/uid_map", uidmap, 0o600)
+		if unshareflags&unix.CLONE_NEWNS == unix.CLONE_NEWNS {
+			err = s.do("mount", "mount(none, /, MS_REC|MS_PRIVATE)", func() error {
+				return unix.Mount("none", "/", "", unix.MS_REC|unix.MS_PRIVATE, "")
+			})
 			if err != nil {
 				return err
 			}
 		}
+	}
 
-		if sys.Unshareflags&unix.CLONE_NEWNS == unix.CLONE_NEWNS {
-			err = unix.Mount("none", "/", "", unix.MS_REC|unix.MS_PRIVATE, "")
-			if err != nil {
-				return err
-			}
+	if s.opts.LoopbackUp {
+		err = s.do("netlink", "RTM_NEWLINK(lo, IFF_UP)", func() error {
+			return setLinkUp("lo")
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.opts.Hostname != "" {
+		err = s.do("sethostname", fmt.Sprintf("sethostname(%q)", s.opts.Hostname), func() error {
+			return unix.Sethostname([]byte(s.opts.Hostname))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.opts.Domainname != "" {
+		err = s.do("setdomainname", fmt.Sprintf("setdomainname(%q)", s.opts.Domainname), func() error {
+			return unix.Setdomainname([]byte(s.opts.Domainname))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The rest happens in a child of the init of the new PID namespace.
+	if pidInit {
+		return execPidInit(s, argv0, argv, attr, sys, unshareflags)
+	}
+
+	err = applyMounts(s, s.opts.Mounts)
+	if err != nil {
+		return err
+	}
+	if s.opts.PivotRoot != "" {
+		err = pivotRoot(s, s.opts.PivotRoot)
+		if err != nil {
+			return err
 		}
 	}
 
 	if sys.Chroot != "" {
-		err = unix.Chroot(sys.Chroot)
+		err = chroot(s, sys.Chroot, argv0)
 		if err != nil {
 			return err
 		}
@@ -123,39 +252,49 @@ func execProcessUnix(argv0 string, argv []string, attr *syscall.ProcAttr, sys *u
 			}
 		}
 		if !(sys.GidMappings != nil && sys.GidMappingsEnableSetgroups && ngroups == 0) && !cred.NoSetGroups {
-			err = unix.Setgroups(groups)
+			err = s.do("setgroups", fmt.Sprintf("setgroups(%v)", groups), func() error {
+				return syscall.Setgroups(groups)
+			})
 			if err != nil {
 				return err
 			}
 		}
-		err = unix.Setgid(int(cred.Gid))
+		err = s.do("setgid", fmt.Sprintf("setgid(%d)", cred.Gid), func() error {
+			return unix.Setgid(int(cred.Gid))
+		})
 		if err != nil {
 			return err
 		}
-		err = unix.Setuid(int(cred.Uid))
+		err = s.do("setuid", fmt.Sprintf("setuid(%d)", cred.Uid), func() error {
+			return unix.Setuid(int(cred.Uid))
+		})
 		if err != nil {
 			return err
 		}
 	}
 
 	if len(sys.AmbientCaps) != 0 {
-		var capHeader unix.CapUserHeader
-		var capData [2]unix.CapUserData
-		capHeader.Version = unix.LINUX_CAPABILITY_VERSION_3
-		err = unix.Capget(&capHeader, &capData[0])
-		if err != nil {
-			return err
-		}
-		for _, c := range sys.AmbientCaps {
-			capData[c>>5].Permitted |= 1 << uint(c&31)
-			capData[c>>5].Inheritable |= 1 << uint(c&31)
-		}
-		err = unix.Capset(&capHeader, &capData[0])
+		err = s.do("capset", fmt.Sprintf("capset(%v)", sys.AmbientCaps), func() error {
+			var capHeader unix.CapUserHeader
+			var capData [2]unix.CapUserData
+			capHeader.Version = unix.LINUX_CAPABILITY_VERSION_3
+			err := unix.Capget(&capHeader, &capData[0])
+			if err != nil {
+				return err
+			}
+			for _, c := range sys.AmbientCaps {
+				capData[c>>5].Permitted |= 1 << uint(c&31)
+				capData[c>>5].Inheritable |= 1 << uint(c&31)
+			}
+			return unix.Capset(&capHeader, &capData[0])
+		})
 		if err != nil {
 			return err
 		}
 		for _, c := range sys.AmbientCaps {
-			err = unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, c, 0, 0)
+			err = s.do("prctl", fmt.Sprintf("prctl(PR_CAP_AMBIENT, PR_CAP_AMBIENT_RAISE, %d)", c), func() error {
+				return unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, c, 0, 0)
+			})
 			if err != nil {
 				return err
 			}
@@ -163,74 +302,172 @@ func execProcessUnix(argv0 string, argv []string, attr *syscall.ProcAttr, sys *u
 	}
 
 	if attr.Dir != "" {
-		err = os.Chdir(attr.Dir)
+		err = s.doReversible("chdir", fmt.Sprintf("chdir(%q)", attr.Dir), func() (func(), error) {
+			cwd, err := unix.Open(".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+			if err != nil {
+				return nil, err
+			}
+			err = os.Chdir(attr.Dir)
+			if err != nil {
+				_ = unix.Close(cwd)
+				return nil, err
+			}
+			return func() {
+				_ = unix.Fchdir(cwd)
+				_ = unix.Close(cwd)
+			}, nil
+		})
 		if err != nil {
 			return err
 		}
 	}
 
 	if sys.Pdeathsig != 0 {
-		err = unix.Prctl(unix.PR_SET_PDEATHSIG, uintptr(sys.Pdeathsig), 0, 0, 0)
+		err = s.do("prctl", fmt.Sprintf("prctl(PR_SET_PDEATHSIG, %d)", sys.Pdeathsig), func() error {
+			return unix.Prctl(unix.PR_SET_PDEATHSIG, uintptr(sys.Pdeathsig), 0, 0, 0)
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	for i, f := range fd {
-		if f >= 0 && f < i {
-			err = unix.Dup3(f, nextfd, unix.O_CLOEXEC)
-			if err != nil {
-				return err
-			}
-			fd[i] = nextfd
-			nextfd++
-		}
-	}
-
-	for i, f := range fd {
-		if f == -1 {
-			_ = unix.Close(i)
-			continue
+	ops, minfd := remapFds(fd, nextfd)
+	for _, op := range ops {
+		switch op.kind {
+		case fdOpMove:
+			err = s.doReversible("dup", fmt.Sprintf("dup3(%d, %d, O_CLOEXEC)", op.from, op.to), func() (func(), error) {
+				return dupFd(op.from, op.to, unix.O_CLOEXEC, minfd)
+			})
+		case fdOpDup:
+			err = s.doReversible("dup", fmt.Sprintf("dup3(%d, %d, 0)", op.from, op.to), func() (func(), error) {
+				return dupFd(op.from, op.to, 0, minfd)
+			})
+		case fdOpInherit:
+			err = s.doReversible("dup", fmt.Sprintf("fcntl(%d, F_SETFD, 0)", op.to), func() (func(), error) {
+				flags, err := unix.FcntlInt(uintptr(op.to), unix.F_GETFD, 0)
+				if err != nil {
+					return nil, err
+				}
+				_, err = unix.FcntlInt(uintptr(op.to), unix.F_SETFD, 0)
+				if err != nil {
+					return nil, err
+				}
+				return func() { _, _ = unix.FcntlInt(uintptr(op.to), unix.F_SETFD, flags) }, nil
+			})
+		case fdOpClose:
+			_ = s.doReversible("close", fmt.Sprintf("close(%d)", op.to), func() (func(), error) {
+				restore, err := saveFd(op.to, minfd)
+				if err != nil {
+					return nil, err
+				}
+				err = unix.Close(op.to)
+				if err != nil {
+					restore()
+					return nil, err
+				}
+				return restore, nil
+			})
 		}
-		if f == i {
-			_, err = unix.FcntlInt(uintptr(f), unix.F_SETFD, 0)
-			if err != nil {
-				return err
-			}
-			continue
-		}
-		err = unix.Dup3(f, i, 0)
 		if err != nil {
 			return err
 		}
 	}
 
-	for i := len(fd); i < 3; i++ {
-		_ = unix.Close(i)
+	if s.opts.CloseOtherFds {
+		err = closeOtherFds(s, len(fd))
+		if err != nil {
+			return err
+		}
 	}
 
 	if sys.Noctty {
-		err = unix.IoctlSetInt(0, unix.TIOCNOTTY, 0)
+		err = s.do("ioctl", "ioctl(0, TIOCNOTTY)", func() error {
+			return unix.IoctlSetInt(0, unix.TIOCNOTTY, 0)
+		})
 		if err != nil {
 			return err
 		}
 	}
 
 	if sys.Setctty {
-		err = unix.IoctlSetPointerInt(sys.Ctty, unix.TIOCSCTTY, 1)
+		err = s.do("ioctl", fmt.Sprintf("ioctl(%d, TIOCSCTTY)", sys.Ctty), func() error {
+			return unix.IoctlSetPointerInt(sys.Ctty, unix.TIOCSCTTY, 1)
+		})
 		if err != nil {
 			return err
 		}
 	}
 
 	if sys.Ptrace {
-		_, err = ptrace(unix.PTRACE_TRACEME, 0, 0, 0)
+		err = s.do("ptrace", "ptrace(PTRACE_TRACEME)", func() error {
+			_, err := ptrace(unix.PTRACE_TRACEME, 0, 0, 0)
+			return err
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	return unix.Exec(argv0, argv, attr.Env)
+	return s.do("execve", fmt.Sprintf("execve(%q, %q)", argv0, argv), func() error {
+		return execve(argv0, argv, attr.Env)
+	})
+}
+
+// dupFd makes to a copy of from, with the given flags for dup3(2), and returns a
+// function that restores to. See saveFd.
+func dupFd(from int, to int, flags int, minfd int) (restore func(), err error) {
+	restore, err = saveFd(to, minfd)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Dup3(from, to, flags)
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
+
+// saveFd returns a function that restores fd to its current state: the open file
+// description and close-on-exec flag it has now, or closed if it isn't open. The
+// copy that it keeps in the meantime is placed at or above minfd.
+func saveFd(fd int, minfd int) (restore func(), err error) {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	if err == unix.EBADF {
+		return func() { _ = unix.Close(fd) }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, minfd)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		dupflags := 0
+		if flags&unix.FD_CLOEXEC != 0 {
+			dupflags = unix.O_CLOEXEC
+		}
+		_ = unix.Dup3(saved, fd, dupflags)
+		_ = unix.Close(saved)
+	}, nil
+}
+
+// cloneNamespaceFlags are the clone(2) flags that unshare(2) accepts too.
+const cloneNamespaceFlags = unix.CLONE_NEWNS | unix.CLONE_NEWUTS | unix.CLONE_NEWIPC | unix.CLONE_NEWUSER |
+	unix.CLONE_NEWPID | unix.CLONE_NEWNET | unix.CLONE_NEWCGROUP | unix.CLONE_NEWTIME
+
+// writeCgroupProcs moves the process pid into the cgroup whose directory is open as
+// dirfd, like clone(2) with CLONE_INTO_CGROUP would for a new process.
+func writeCgroupProcs(dirfd int, pid int) error {
+	fd, err := unix.Openat(dirfd, "cgroup.procs", unix.O_WRONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "cgroup.procs")
+	defer f.Close()
+	_, err = f.WriteString(strconv.Itoa(pid))
+	return err
 }
 
 func ptrace(op int, pid int, addr uintptr, data uintptr) (int, error) {
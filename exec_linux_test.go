@@ -0,0 +1,1479 @@
+package exec_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	jcbhmrexec "github.com/jcbhmr/go-exec"
+	"github.com/jcbhmr/go-exec/internal/constructor"
+	_ "github.com/jcbhmr/go-exec/nsenter"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	helpers["exec"] = func(args []string) {
+		cmd := exec.Command(args[0], args[1:]...)
+		err := (*jcbhmrexec.CmdExt)(cmd).Exec()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-profiling"] = func(args []string) {
+		if err := pprof.StartCPUProfile(io.Discard); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		helpers["exec"](args)
+	}
+	helpers["exec-fork-stress"] = func(args []string) {
+		_, w, err := os.Pipe()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		pipe, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", w.Fd()))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for range 8 {
+			go func() {
+				for {
+					cmd := exec.Command("sh", "-c", `[ "$(readlink /proc/self/fd/3)" = "$1" ] && echo leak >&2`, "sh", pipe)
+					cmd.Stderr = os.Stderr
+					_ = cmd.Run()
+				}
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.ExtraFiles = []*os.File{w}
+		err = (*jcbhmrexec.CmdExt)(cmd).Exec()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-cgroup"] = func(args []string) {
+		dir, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cmd := exec.Command(args[1], args[2:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			UseCgroupFD: true,
+			CgroupFD:    int(dir.Fd()),
+		}
+		err = (*jcbhmrexec.CmdExt)(cmd).Exec()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-cloneflags"] = func(args []string) {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUTS,
+		}
+		err := (*jcbhmrexec.CmdExt)(cmd).Exec()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-userns"] = func(args []string) {
+		busy()
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Unshareflags: syscall.CLONE_NEWUSER,
+			UidMappings:  []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+			GidMappings:  []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		}
+		err := (*jcbhmrexec.CmdExt)(cmd).Exec()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-pid-init"] = func(args []string) {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Unshareflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+		}
+		err := (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{PidInit: true})
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-rootfs"] = func(args []string) {
+		cmd := exec.Command(args[1], args[2:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWNS}
+		err := (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{Mounts: rootfsMounts(args[0]), PivotRoot: args[0]})
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-pid-init-rootfs"] = func(args []string) {
+		cmd := exec.Command(args[1], args[2:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS}
+		err := (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{PidInit: true, Mounts: rootfsMounts(args[0]), PivotRoot: args[0]})
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-chroot"] = func(args []string) {
+		root := args[0]
+		mounts := []jcbhmrexec.Mount{{Type: "tmpfs", Target: root}}
+		for _, dir := range []string{"usr", "bin", "lib", "lib64"} {
+			if _, err := os.Stat(filepath.Join("/", dir)); err == nil {
+				mounts = append(mounts, jcbhmrexec.Mount{Type: "bind", Source: filepath.Join("/", dir), Target: filepath.Join(root, dir), Recursive: true})
+			}
+		}
+		cmd := &exec.Cmd{Path: args[2], Args: args[2:], Dir: args[1]}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWNS, Chroot: root}
+		err := (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{Mounts: mounts})
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-setns"] = func(args []string) {
+		busy()
+		var namespaces []jcbhmrexec.Namespace
+		for _, path := range strings.Split(args[0], ",") {
+			namespaces = append(namespaces, jcbhmrexec.Namespace{Path: path})
+		}
+		cmd := exec.Command(args[1], args[2:]...)
+		err := (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{Namespaces: namespaces})
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-setns-pidfd"] = func(args []string) {
+		pid, _ := strconv.Atoi(args[0])
+		flags, _ := strconv.ParseUint(args[1], 0, 64)
+		pidfd, err := unix.PidfdOpen(pid, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cmd := exec.Command(args[2], args[3:]...)
+		err = (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{
+			Namespaces: []jcbhmrexec.Namespace{{UsePidFD: true, PidFD: pidfd, Type: uintptr(flags)}},
+		})
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-setns-unprivileged"] = func(args []string) {
+		// The holder exits once the write end of its standard input is closed on exec,
+		// but the namespace files that Exec opened keep the namespaces alive.
+		holder, _, err := startNamespaceHolder(&syscall.SysProcAttr{
+			Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cannot create namespaces:", err)
+			os.Exit(1)
+		}
+		ns := fmt.Sprintf("/proc/%d/ns/", holder.Process.Pid)
+		netns, err := os.Readlink(ns + "net")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(netns)
+		// The network namespace is listed first, but can only be entered from the user
+		// namespace that owns it.
+		cmd := exec.Command(args[0], args[1:]...)
+		err = (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{
+			Namespaces: []jcbhmrexec.Namespace{{Path: ns + "net"}, {Path: ns + "user"}},
+		})
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-sandbox"] = func(args []string) {
+		self, err := os.Executable()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cmd := exec.Command(self, "-test.run=^TestHelperProcess$", "--", "sandbox-info", args[0])
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Unshareflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET | syscall.CLONE_NEWUTS,
+			UidMappings:  []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+			GidMappings:  []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		}
+		opts := &jcbhmrexec.ExecOptions{LoopbackUp: true, Hostname: "sandbox", Domainname: "example.test"}
+		switch args[0] {
+		case "time":
+			cmd.SysProcAttr.Unshareflags |= unix.CLONE_NEWTIME
+			opts.MonotonicOffset = 1000 * time.Hour
+			opts.BoottimeOffset = 2000*time.Hour - time.Millisecond
+		case "pid-init":
+			cmd.SysProcAttr.Unshareflags |= unix.CLONE_NEWPID | unix.CLONE_NEWNS
+			opts.PidInit = true
+		}
+		err = (*jcbhmrexec.CmdExt)(cmd).ExecWith(opts)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["sandbox-info"] = func(args []string) {
+		hostname, _ := os.Hostname()
+		domainname, _ := os.ReadFile("/proc/sys/kernel/domainname")
+		fmt.Println(hostname)
+		fmt.Print(string(domainname))
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			var conn net.Conn
+			conn, err = net.Dial("tcp", ln.Addr().String())
+			if err == nil {
+				conn.Close()
+			}
+			ln.Close()
+		}
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("loopback")
+		}
+		if args[0] == "pid-init" {
+			fmt.Println(os.Getppid())
+		}
+		if args[0] == "time" {
+			for _, clock := range []int32{unix.CLOCK_MONOTONIC, unix.CLOCK_BOOTTIME} {
+				var ts unix.Timespec
+				_ = unix.ClockGettime(clock, &ts)
+				fmt.Println(time.Duration(ts.Nano()).Truncate(1000 * time.Hour))
+			}
+		}
+		os.Exit(0)
+	}
+	helpers["emulate"] = func(args []string) {
+		cmd := exec.Command(args[0], args[1:]...)
+		err := (*jcbhmrexec.CmdExt)(cmd).EmulateExec()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-or-run-reader"] = func(args []string) {
+		cmd := exec.Command(args[0], args[1:]...)
+		// A reader of unknown size can't be buffered by Exec by default.
+		cmd.Stdin = io.MultiReader(strings.NewReader("hello\n"))
+		err := (*jcbhmrexec.CmdExt)(cmd).ExecOrRun()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-stdio"] = func(args []string) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "print-stdio")
+		cmd.Stderr = os.Stderr
+		err := (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{NullStdio: args[0] == "null"})
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-inetd"] = func(args []string) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(ln.Addr())
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		var stdio any = conn
+		if args[0] == "unwrapper" {
+			stdio = connWrapper{conn.(*net.TCPConn)}
+			jcbhmrexec.RegisterFileUnwrapper(func(v any) (fd uintptr, ok bool) {
+				w, ok := v.(connWrapper)
+				if !ok {
+					return 0, false
+				}
+				rc, err := w.c.SyscallConn()
+				if err != nil {
+					return 0, false
+				}
+				_ = rc.Control(func(f uintptr) { fd = f })
+				return fd, true
+			})
+		}
+		cmd := exec.Command(args[1], args[2:]...)
+		cmd.Stdin = stdio.(io.Reader)
+		cmd.Stdout = stdio.(io.Writer)
+		err = (*jcbhmrexec.CmdExt)(cmd).Exec()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-reader"] = func(args []string) {
+		cmd := exec.Command(args[1], args[2:]...)
+		opts := &jcbhmrexec.ExecOptions{}
+		switch args[0] {
+		case "known":
+			cmd.Stdin = bytes.NewReader(readerData)
+		case "unknown":
+			cmd.Stdin = io.MultiReader(bytes.NewReader(readerData))
+			opts.MaxStdinBuffer = int64(len(readerData))
+		case "too-large":
+			cmd.Stdin = io.MultiReader(bytes.NewReader(readerData))
+			opts.MaxStdinBuffer = int64(len(readerData)) - 1
+		}
+		err := (*jcbhmrexec.CmdExt)(cmd).ExecWith(opts)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-peek"] = func(args []string) {
+		br := bufio.NewReader(os.Stdin)
+		peeked, err := br.Peek(len("hello\n"))
+		if err != nil || string(peeked) != "hello\n" {
+			fmt.Fprintf(os.Stderr, "peeked %q: %v\n", peeked, err)
+			os.Exit(1)
+		}
+		cmd := exec.Command(args[1], args[2:]...)
+		switch args[0] {
+		case "bufio":
+			cmd.Stdin = br
+		case "multi":
+			prefix := make([]byte, br.Buffered())
+			_, _ = io.ReadFull(br, prefix)
+			cmd.Stdin = io.MultiReader(bytes.NewReader(prefix), os.Stdin)
+		case "dir":
+			dir, err := os.Open("/")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			cmd.Stdin = io.MultiReader(strings.NewReader("hello\n"), dir)
+		case "fail":
+			cmd.Stdin = br
+			cmd.Path = "/dev/null"
+			if err := (*jcbhmrexec.CmdExt)(cmd).Exec(); err == nil {
+				os.Exit(1)
+			}
+			// Exec failed, so everything is left to read from br.
+			_, _ = io.Copy(os.Stdout, br)
+			os.Exit(0)
+		}
+		err = (*jcbhmrexec.CmdExt)(cmd).Exec()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-fd-map"] = func(args []string) {
+		a, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		b, err := os.Open(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cmd := exec.Command("readlink")
+		for fd := 3; fd < 10; fd++ {
+			cmd.Args = append(cmd.Args, fmt.Sprintf("/proc/self/fd/%d", fd))
+		}
+		cmd.ExtraFiles = []*os.File{b}
+		err = (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{
+			Files: map[int]*os.File{9: a, 5: b, 3: nil},
+			Fds:   map[int]int{7: int(a.Fd()), 4: 2},
+		})
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-leak"] = func(args []string) {
+		fd, err := unix.Open(os.DevNull, unix.O_RDONLY, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cmd := exec.Command("readlink", fmt.Sprintf("/proc/self/fd/%d", fd))
+		err = (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{CloseOtherFds: args[0] == "close"})
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["print-stdio"] = func(args []string) {
+		for _, fd := range []string{"0", "1"} {
+			target, err := os.Readlink("/proc/self/fd/" + fd)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Fprintln(os.Stderr, target)
+		}
+		os.Exit(0)
+	}
+	helpers["exec-busy-credential"] = func(args []string) {
+		busy()
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: 65534, Gid: 65534, Groups: []uint32{65534}},
+		}
+		err := (*jcbhmrexec.CmdExt)(cmd).Exec()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["exec-busy-unshare"] = func(args []string) {
+		busy()
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Unshareflags: syscall.CLONE_NEWUTS,
+		}
+		err := (*jcbhmrexec.CmdExt)(cmd).Exec()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func TestExecRestoresRlimitNofile(t *testing.T) {
+	helper := helperCommand(t, "exec", "cat", "/proc/self/limits")
+	cmd := exec.Command("sh", append([]string{"-c", `ulimit -Sn 256 && exec "$@"`, "sh"}, helper.Args...)...)
+	cmd.Env = helper.Env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if fields, ok := strings.CutPrefix(sc.Text(), "Max open files"); ok {
+			if soft := strings.Fields(fields)[0]; soft != "256" {
+				t.Fatalf("expected soft RLIMIT_NOFILE 256, got %s", soft)
+			}
+			return
+		}
+	}
+	t.Fatalf("no open files limit in:\n%s", out)
+}
+
+func TestExecStopsProfilingTimer(t *testing.T) {
+	cmd := helperCommand(t, "exec-profiling", "sh", "-c", `i=0; while [ $i -lt 300000 ]; do i=$((i+1)); done; echo ok`)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+	if string(out) != "ok\n" {
+		t.Fatalf("expected %q, got %q", "ok\n", out)
+	}
+}
+
+// busy keeps GOMAXPROCS goroutines running so that the runtime spreads work over
+// several OS threads.
+func busy() {
+	runtime.GOMAXPROCS(4)
+	for range 8 {
+		go func() {
+			for {
+				runtime.Gosched()
+			}
+		}()
+	}
+}
+
+func TestExecMultiThreadedCredential(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	for range 20 {
+		cmd := helperCommand(t, "exec-busy-credential", "id", "-G")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+		}
+		if string(out) != "65534\n" {
+			t.Fatalf("expected groups %q, got %q", "65534\n", out)
+		}
+	}
+}
+
+func TestExecMultiThreadedUnshare(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	uts, err := os.Readlink("/proc/self/ns/uts")
+	if err != nil {
+		t.Skip(err)
+	}
+	for range 20 {
+		cmd := helperCommand(t, "exec-busy-unshare", "readlink", "/proc/self/ns/uts")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+		}
+		if strings.TrimSpace(string(out)) == uts {
+			t.Fatalf("exec'd program is still in UTS namespace %s", uts)
+		}
+	}
+}
+
+func TestExecUserns(t *testing.T) {
+	testExecUserns(t, helperCommand(t, "exec-userns", "sh", "-c", "id -u; id -g; readlink /proc/self/ns/user"))
+}
+
+func TestExecUsernsUnprivileged(t *testing.T) {
+	if os.Geteuid() != 0 {
+		testExecUserns(t, helperCommand(t, "exec-userns", "sh", "-c", "id -u; id -g; readlink /proc/self/ns/user"))
+		return
+	}
+
+	cmd := helperCommand(t, "exec-userns", "sh", "-c", "id -u; id -g; readlink /proc/self/ns/user")
+	asNobody(t, cmd)
+	testExecUserns(t, cmd)
+}
+
+// asNobody makes cmd, which runs the test binary, run a copy of it that the nobody
+// user can execute as that user.
+func asNobody(t *testing.T, cmd *exec.Cmd) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "go-exec-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Chmod(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "test")
+	data, err := os.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bin, data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Path = bin
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: 65534, Gid: 65534},
+	}
+}
+
+// testExecUserns runs cmd, which execs a shell in a new user namespace that prints
+// its user and group IDs and its user namespace, and checks that it is root in a
+// namespace other than the current one.
+func testExecUserns(t *testing.T, cmd *exec.Cmd) {
+	t.Helper()
+	userns, err := os.Readlink("/proc/self/ns/user")
+	if err != nil {
+		t.Skip(err)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(out), ": unshare: ") || strings.Contains(string(out), "cgo") {
+			t.Skipf("cannot create a user namespace: %s", out)
+		}
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 3 || lines[0] != "0" || lines[1] != "0" || lines[2] == userns {
+		t.Fatalf("expected uid 0 and gid 0 in a user namespace other than %s, got:\n%s", userns, out)
+	}
+}
+
+func TestExecPidInit(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	// The shell is a child of the init, and once the init has reaped the orphaned
+	// sleep, the fresh /proc shows only the two of them. The shell counts them
+	// without starting any other process.
+	script := `echo $PPID
+orphan=$(sh -c 'sleep 0.1 >/dev/null & echo $!')
+while [ -e /proc/$orphan ]; do sleep 0.01; done
+n=0; for p in /proc/[0-9]*; do n=$((n+1)); done; echo $n
+exit 7`
+	cmd := helperCommand(t, "exec-pid-init", "sh", "-c", script)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 7 {
+		t.Fatalf("%q: expected exit status 7, got %v\n%s", cmd, err, out)
+	}
+	if string(out) != "1\n2\n" {
+		t.Fatalf("expected %q, got %q", "1\n2\n", out)
+	}
+}
+
+func TestExecPidInitSignaled(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	cmd := helperCommand(t, "exec-pid-init", "sh", "-c", "kill -TERM $$")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 128+int(syscall.SIGTERM) {
+		t.Fatalf("%q: expected exit status %d, got %v\n%s", cmd, 128+int(syscall.SIGTERM), err, out)
+	}
+}
+
+// rootfsMounts returns the Mounts that set up a minimal root directory at root, with
+// read-only system directories, /dev, and a /proc without /proc/sys.
+func rootfsMounts(root string) []jcbhmrexec.Mount {
+	mounts := []jcbhmrexec.Mount{
+		{Type: "tmpfs", Target: root},
+		{Type: "bind", Source: "/usr", Target: filepath.Join(root, "usr"), ReadOnly: true, Recursive: true},
+	}
+	for _, dir := range []string{"bin", "lib", "lib64"} {
+		if _, err := os.Stat(filepath.Join("/", dir)); err == nil {
+			mounts = append(mounts, jcbhmrexec.Mount{Type: "bind", Source: filepath.Join("/", dir), Target: filepath.Join(root, dir), ReadOnly: true})
+		}
+	}
+	return append(mounts,
+		jcbhmrexec.Mount{Type: "dev", Target: filepath.Join(root, "dev")},
+		jcbhmrexec.Mount{Type: "proc", Target: filepath.Join(root, "proc")},
+		jcbhmrexec.Mount{Type: "mask", Target: filepath.Join(root, "proc/sys")},
+	)
+}
+
+func TestExecRootfs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	root := t.TempDir()
+	script := `test -e /etc && echo etc; test -c /dev/null && echo null; ls /proc/sys | wc -l; touch /usr/x 2>/dev/null || echo ro; pwd`
+	cmd := helperCommand(t, "exec-rootfs", root, "sh", "-c", script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+	if want := "null\n0\nro\n/\n"; string(out) != want {
+		t.Fatalf("expected %q, got %q", want, out)
+	}
+	// The mounts were in a mount namespace of their own.
+	entries, err := os.ReadDir(root)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected %s to be empty, got %v, %v", root, entries, err)
+	}
+}
+
+func TestExecPidInitRootfs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	// The /proc that Mounts put below PivotRoot is the one of the new PID namespace.
+	script := `echo $PPID; n=0; for p in /proc/[0-9]*; do n=$((n+1)); done; echo $n`
+	cmd := helperCommand(t, "exec-pid-init-rootfs", t.TempDir(), "sh", "-c", script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+	if string(out) != "1\n2\n" {
+		t.Fatalf("expected %q, got %q", "1\n2\n", out)
+	}
+}
+
+func TestExecMountsNeedMountNamespace(t *testing.T) {
+	cmd := exec.Command("/nonexistent/go-exec-test")
+	err := (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{
+		Mounts: []jcbhmrexec.Mount{{Type: "tmpfs", Target: t.TempDir()}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "CLONE_NEWNS") {
+		t.Fatalf("expected an error about CLONE_NEWNS, got %v", err)
+	}
+}
+
+func TestPlanDevMount(t *testing.T) {
+	cmd := exec.Command("/bin/true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWNS}
+	p, err := (*jcbhmrexec.CmdExt)(cmd).PlanWith(&jcbhmrexec.ExecOptions{
+		Mounts: []jcbhmrexec.Mount{{Type: "dev", Target: "/newroot/dev"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := map[string]bool{}
+	for _, step := range p.Steps {
+		ops[step.Op] = true
+	}
+	for _, op := range []string{"mount", "mknod", "mkdir", "symlink"} {
+		if !ops[op] {
+			t.Errorf("expected a %q step, got %+v", op, p.Steps)
+		}
+	}
+}
+
+func TestPlanReexec(t *testing.T) {
+	cmd := exec.Command("/bin/true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Unshareflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+		UidMappings:  []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+	}
+	p, err := (*jcbhmrexec.CmdExt)(cmd).PlanWith(&jcbhmrexec.ExecOptions{PidInit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The current executable is re-executed in the new user namespace, and then once
+	// more to clone the init, before the new program.
+	var calls []string
+	for _, step := range p.Steps {
+		if strings.HasPrefix(step.Call, "execve(") || step.Op == "unshare" || step.Op == "uid_map" || step.Op == "clone" {
+			calls = append(calls, step.Call)
+		}
+	}
+	uidMap := fmt.Sprintf("write(%q, %q)", fmt.Sprintf("/proc/%d/uid_map", os.Getpid()), fmt.Sprintf("0 %d 1\n", os.Getuid()))
+	want := []string{
+		`execve("/proc/self/exe", ["github.com/jcbhmr/go-exec.execRest"])`,
+		"unshare(CLONE_NEWUSER)",
+		uidMap,
+		"unshare(0x20000)",
+		`execve("/proc/self/exe", ["github.com/jcbhmr/go-exec.pidProxy"])`,
+		"clone(CLONE_NEWPID)",
+		"clone()",
+		`execve("/proc/self/exe", ["github.com/jcbhmr/go-exec.execRest"])`,
+		`execve("/bin/true", ["/bin/true"])`,
+	}
+	if !slices.Equal(calls, want) {
+		t.Fatalf("expected calls\n%s\ngot\n%s\nin plan\n%s", strings.Join(want, "\n"), strings.Join(calls, "\n"), p)
+	}
+}
+
+func TestPlanSetnsTimeOffsets(t *testing.T) {
+	cmd := exec.Command("/bin/true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWTIME}
+	p, err := (*jcbhmrexec.CmdExt)(cmd).PlanWith(&jcbhmrexec.ExecOptions{
+		Namespaces:      []jcbhmrexec.Namespace{{Path: "/proc/self/ns/mnt"}},
+		MonotonicOffset: time.Hour,
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	// The offsets carry over to the re-executed current executable, which enters
+	// the mount namespace first.
+	if !strings.Contains(p.String(), "unshare(CLONE_NEWTIME)\n") || !strings.Contains(p.String(), `"monotonic 3600 0\n"`) {
+		t.Fatalf("expected the time namespace offsets in the plan, got\n%s", p)
+	}
+}
+
+func TestExecSandbox(t *testing.T) {
+	testExecSandbox(t, "", "sandbox\nexample.test\nloopback\n")
+}
+
+func TestExecTimeOffsets(t *testing.T) {
+	if _, err := os.Stat("/proc/self/ns/time"); err != nil {
+		t.Skip(err)
+	}
+	// The offsets exceed the uptime of the machine running the test, unless it has
+	// been up for more than 1000 hours.
+	testExecSandbox(t, "time", "sandbox\nexample.test\nloopback\n1000h0m0s\n2000h0m0s\n")
+}
+
+func TestExecSandboxPidInit(t *testing.T) {
+	// The new program is a child of the init.
+	testExecSandbox(t, "pid-init", "sandbox\nexample.test\nloopback\n1\n")
+}
+
+// testExecSandbox runs the exec-sandbox helper with mode, unprivileged, and checks
+// that it prints want.
+func testExecSandbox(t *testing.T, mode string, want string) {
+	t.Helper()
+	cmd := helperCommand(t, "exec-sandbox", mode)
+	if os.Geteuid() == 0 {
+		asNobody(t, cmd)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(out), ": unshare: ") || strings.Contains(string(out), "cgo") {
+			t.Skipf("cannot create the namespaces: %s", out)
+		}
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+	if string(out) != want {
+		t.Fatalf("expected %q, got %q", want, out)
+	}
+}
+
+func TestExecLoopbackUpNeedsNetworkNamespace(t *testing.T) {
+	cmd := exec.Command("/nonexistent/go-exec-test")
+	err := (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{LoopbackUp: true})
+	if err == nil || !strings.Contains(err.Error(), "CLONE_NEWNET") {
+		t.Fatalf("expected an error about CLONE_NEWNET, got %v", err)
+	}
+}
+
+func TestExecChroot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	for _, tt := range []struct{ dir, path, want string }{
+		{"", "/bin/sh", "/\n"},
+		{"usr", "/bin/sh", "/usr\n"},
+		{"/usr", "bin/sh", "/usr\n"},
+		{"", "bin/sh", "/\n"},
+	} {
+		cmd := helperCommand(t, "exec-chroot", t.TempDir(), tt.dir, tt.path, "-c", "pwd")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+		}
+		if string(out) != tt.want {
+			t.Errorf("Dir %q, Path %q: expected working directory %q, got %q", tt.dir, tt.path, tt.want, out)
+		}
+	}
+}
+
+func TestExecChrootNotFound(t *testing.T) {
+	cmd := exec.Command("/bin/true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: t.TempDir()}
+	err := (*jcbhmrexec.CmdExt)(cmd).Exec()
+	var execErr *jcbhmrexec.ExecError
+	if !errors.As(err, &execErr) || execErr.Op != "chroot" || !errors.Is(err, fs.ErrNotExist) || execErr.Irreversible {
+		t.Fatalf("expected a reversible chroot error for a missing file, got %v", err)
+	}
+}
+
+// startNamespaceHolder starts a process with sys that holds on to the namespaces it
+// creates until the returned writer is closed.
+func startNamespaceHolder(sys *syscall.SysProcAttr) (*exec.Cmd, io.WriteCloser, error) {
+	cmd := exec.Command("cat")
+	cmd.SysProcAttr = sys
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	return cmd, w, cmd.Start()
+}
+
+// holdNamespaces starts a namespace holder with cloneflags for the duration of the
+// test, and returns the paths of its namespace files of the given types.
+func holdNamespaces(t *testing.T, cloneflags uintptr, types ...string) (pid int, paths []string) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	holder, w, err := startNamespaceHolder(&syscall.SysProcAttr{Cloneflags: cloneflags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		w.Close()
+		holder.Wait()
+	})
+	for _, typ := range types {
+		paths = append(paths, fmt.Sprintf("/proc/%d/ns/%s", holder.Process.Pid, typ))
+	}
+	return holder.Process.Pid, paths
+}
+
+// readlinks returns the targets of the symbolic links at paths, one per line.
+func readlinks(t *testing.T, paths []string) string {
+	t.Helper()
+	var b strings.Builder
+	for _, path := range paths {
+		target, err := os.Readlink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.WriteString(target + "\n")
+	}
+	return b.String()
+}
+
+func TestExecNamespaces(t *testing.T) {
+	types := []string{"net", "uts", "ipc"}
+	_, paths := holdNamespaces(t, syscall.CLONE_NEWNET|syscall.CLONE_NEWUTS|syscall.CLONE_NEWIPC, types...)
+	cmd := helperCommand(t, "exec-setns", strings.Join(paths, ","), "readlink", "/proc/self/ns/net", "/proc/self/ns/uts", "/proc/self/ns/ipc")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+	if want := readlinks(t, paths); string(out) != want {
+		t.Fatalf("expected namespaces %q, got %q", want, out)
+	}
+}
+
+func TestExecNamespacesPidFD(t *testing.T) {
+	const flags = syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS
+	pid, paths := holdNamespaces(t, flags, "mnt", "pid", "uts")
+	// Entering the PID namespace leaves a parent behind that exits like its child.
+	script := "readlink /proc/self/ns/mnt /proc/self/ns/pid /proc/self/ns/uts; exit 3"
+	cmd := helperCommand(t, "exec-setns-pidfd", strconv.Itoa(pid), strconv.Itoa(flags), "sh", "-c", script)
+	out, err := cmd.CombinedOutput()
+	if strings.Contains(string(out), "cgo") {
+		t.Skipf("cannot enter the namespaces: %s", out)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("%q: expected exit status 3, got %v\n%s", cmd, err, out)
+	}
+	if want := readlinks(t, paths); string(out) != want {
+		t.Fatalf("expected namespaces %q, got %q", want, out)
+	}
+}
+
+func TestExecNamespacesNegativePidFD(t *testing.T) {
+	cmd := exec.Command("/nonexistent/go-exec-test")
+	err := (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{
+		Namespaces: []jcbhmrexec.Namespace{{UsePidFD: true, PidFD: -2, Type: syscall.CLONE_NEWNET}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "negative PidFD") {
+		t.Fatalf("expected an error about the negative PidFD, got %v", err)
+	}
+}
+
+func TestExecNamespacesUnprivileged(t *testing.T) {
+	cmd := helperCommand(t, "exec-setns-unprivileged", "sh", "-c", "id -u; readlink /proc/self/ns/net")
+	if os.Geteuid() == 0 {
+		asNobody(t, cmd)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(out), "cannot create namespaces") || strings.Contains(string(out), "cgo") {
+			t.Skipf("cannot create namespaces: %s", out)
+		}
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 3 || lines[1] != "0" || lines[2] != lines[0] {
+		t.Fatalf("expected uid 0 in network namespace %s, got:\n%s", lines[0], out)
+	}
+}
+
+func TestExecNamespacesRollback(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	netns, err := os.Readlink("/proc/thread-self/ns/net")
+	if err != nil {
+		t.Skip(err)
+	}
+	cmd := exec.Command("/bin/true")
+	err = (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{
+		Namespaces: []jcbhmrexec.Namespace{
+			{Path: "/proc/self/ns/net", Type: syscall.CLONE_NEWNET},
+			{Path: "/proc/self/ns/net", Type: syscall.CLONE_NEWUTS},
+		},
+	})
+	var execErr *jcbhmrexec.ExecError
+	if !errors.As(err, &execErr) || execErr.Op != "setns" || !errors.Is(err, syscall.EINVAL) || execErr.Irreversible {
+		t.Fatalf("expected a reversible setns error for the wrong type, got %v", err)
+	}
+	if after, _ := os.Readlink("/proc/thread-self/ns/net"); after != netns {
+		t.Fatalf("expected network namespace %s after rollback, got %s", netns, after)
+	}
+}
+
+func TestExecFailedLeavesThread(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	utsns, err := os.Readlink("/proc/thread-self/ns/uts")
+	if err != nil {
+		t.Skip(err)
+	}
+	// The failed Exec has unshared the UTS namespace of the thread it ran on, which
+	// must not be the thread of the caller.
+	cmd := exec.Command("/nonexistent/go-exec-test")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWUTS}
+	err = (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{Hostname: "go-exec-test"})
+	var execErr *jcbhmrexec.ExecError
+	if !errors.As(err, &execErr) || execErr.Op != "execve" || !execErr.Irreversible {
+		t.Fatalf("expected an irreversible execve error, got %v", err)
+	}
+	if after, _ := os.Readlink("/proc/thread-self/ns/uts"); after != utsns {
+		t.Fatalf("expected UTS namespace %s after a failed Exec, got %s", utsns, after)
+	}
+}
+
+func TestConstructorNeedsEntrypoint(t *testing.T) {
+	userns, err := os.Readlink("/proc/self/ns/user")
+	if err != nil {
+		t.Skip(err)
+	}
+	// Without the entrypoint that Exec starts the current executable for, the
+	// constructor ignores the environment variables meant for it.
+	cmd := helperCommand(t, "exec", "readlink", "/proc/self/ns/user")
+	cmd.Env = append(cmd.Env, "GO_EXEC_USERNS=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+	if string(out) != userns+"\n" {
+		t.Fatalf("expected user namespace %s, got %q", userns, out)
+	}
+}
+
+func TestConstructorChecksSetnsFds(t *testing.T) {
+	if !constructor.Linked {
+		t.Skip("the constructor of package nsenter needs cgo")
+	}
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	// The constructor only enters namespace files and pidfds, which the null device
+	// is neither.
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(),
+		"GO_EXEC_ENTRYPOINT=github.com/jcbhmr/go-exec.check",
+		fmt.Sprintf("GO_EXEC_SETNS=3:%d", syscall.CLONE_NEWNET),
+	)
+	cmd.ExtraFiles = []*os.File{devNull}
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 126 || !strings.Contains(string(out), "setns: Bad file descriptor") {
+		t.Fatalf("expected exit status 126 with a setns error, got %v\n%s", err, out)
+	}
+}
+
+func TestExecForkLock(t *testing.T) {
+	for range 10 {
+		cmd := helperCommand(t, "exec-fork-stress", "sh", "-c", "sleep 0.2; echo done")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+		}
+		if string(out) != "done\n" {
+			t.Fatalf("expected %q, got %q", "done\n", out)
+		}
+	}
+}
+
+func TestExecCgroupFDFake(t *testing.T) {
+	dir := t.TempDir()
+	procs := filepath.Join(dir, "cgroup.procs")
+	if err := os.WriteFile(procs, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := helperCommand(t, "exec-cgroup", dir, "sh", "-c", "echo $$")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+	written, err := os.ReadFile(procs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written)+"\n" != string(out) {
+		t.Fatalf("expected cgroup.procs to contain the exec'd PID %q, got %q", out, written)
+	}
+}
+
+func TestExecCgroupFD(t *testing.T) {
+	parent := "/sys/fs/cgroup"
+	if _, err := os.Stat(filepath.Join(parent, "unified", "cgroup.procs")); err == nil {
+		parent = filepath.Join(parent, "unified")
+	}
+	dir, err := os.MkdirTemp(parent, "go-exec-test-")
+	if err != nil {
+		t.Skip("cannot create a cgroup v2 subtree:", err)
+	}
+	defer os.Remove(dir)
+
+	cmd := helperCommand(t, "exec-cgroup", dir, "cat", "/proc/self/cgroup")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+	want := "0::/" + filepath.Base(dir)
+	if !strings.Contains(string(out), want) {
+		t.Fatalf("expected %q in:\n%s", want, out)
+	}
+}
+
+func TestExecCloneflags(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	uts, err := os.Readlink("/proc/self/ns/uts")
+	if err != nil {
+		t.Skip(err)
+	}
+	cmd := helperCommand(t, "exec-cloneflags", "readlink", "/proc/self/ns/uts")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+	if strings.TrimSpace(string(out)) == uts {
+		t.Fatalf("exec'd program is still in UTS namespace %s", uts)
+	}
+}
+
+func TestExecPidFD(t *testing.T) {
+	var pidfd int
+	cmd := exec.Command("/nonexistent/go-exec-test")
+	cmd.SysProcAttr = &syscall.SysProcAttr{PidFD: &pidfd}
+	err := (*jcbhmrexec.CmdExt)(cmd).Exec()
+	if err == nil || !strings.Contains(err.Error(), "PidFD") {
+		t.Fatalf("expected a PidFD error, got %v", err)
+	}
+}
+
+func TestExecStrict(t *testing.T) {
+	fields := jcbhmrexec.SupportedSysProcAttrFields()
+	if !slices.Contains(fields, "Setsid") || slices.Contains(fields, "PidFD") {
+		t.Fatalf("unexpected supported fields %v", fields)
+	}
+
+	var pidfd int
+	cmd := exec.Command("/nonexistent/go-exec-test")
+	cmd.SysProcAttr = &syscall.SysProcAttr{PidFD: &pidfd}
+	err := (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{Strict: true})
+	var unsupportedErr *jcbhmrexec.UnsupportedSysProcAttrError
+	if !errors.As(err, &unsupportedErr) {
+		t.Fatalf("expected *UnsupportedSysProcAttrError, got %T: %v", err, err)
+	}
+	if !slices.Equal(unsupportedErr.Fields, []string{"PidFD"}) {
+		t.Fatalf("expected unsupported fields [PidFD], got %v", unsupportedErr.Fields)
+	}
+}
+
+func TestExecProcessRollback(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgid, err := syscall.Getpgid(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd0 := describeFd(0)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	fd3 := describeFd(3)
+
+	err = jcbhmrexec.ExecProcess("/nonexistent/go-exec-test", []string{"go-exec-test"}, &os.ProcAttr{
+		Dir:   os.TempDir(),
+		Files: []*os.File{r, os.Stdout, os.Stderr, w},
+		Sys:   &syscall.SysProcAttr{Setpgid: true},
+	})
+	var execErr *jcbhmrexec.ExecError
+	if !errors.As(err, &execErr) || execErr.Op != "execve" {
+		t.Fatalf("expected execve *ExecError, got %T: %v", err, err)
+	}
+	if execErr.Irreversible {
+		t.Errorf("expected a reversible failure")
+	}
+
+	if wd2, _ := os.Getwd(); wd2 != wd {
+		t.Errorf("working directory is %q, expected %q", wd2, wd)
+	}
+	if pgid2, _ := syscall.Getpgid(0); pgid2 != pgid {
+		t.Errorf("process group is %d, expected %d", pgid2, pgid)
+	}
+	if fd0 != describeFd(0) {
+		t.Errorf("fd 0 was not restored")
+	}
+	if fd3 != describeFd(3) {
+		t.Errorf("fd 3 was not restored")
+	}
+}
+
+// describeFd returns a string that identifies the open file description of fd and
+// its close-on-exec flag.
+func describeFd(fd int) string {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	if err != nil {
+		return err.Error()
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprint(st.Dev, st.Ino, flags)
+}
+
+func TestEmulateExecExitStatus(t *testing.T) {
+	cmd := helperCommand(t, "emulate", "sh", "-c", "exit 7")
+	err := cmd.Run()
+	if cmd.ProcessState == nil || cmd.ProcessState.ExitCode() != 7 {
+		t.Fatalf("expected exit status 7, got %v", err)
+	}
+}
+
+func TestEmulateExecUnchangedOnError(t *testing.T) {
+	cmd := exec.Command("/nonexistent/go-exec-test")
+	if err := (*jcbhmrexec.CmdExt)(cmd).EmulateExec(); err == nil {
+		t.Fatal("expected EmulateExec to fail")
+	}
+	if cmd.Stdin != nil || cmd.Stdout != nil || cmd.Stderr != nil || cmd.SysProcAttr != nil {
+		t.Fatalf("EmulateExec changed the Cmd: %+v", cmd)
+	}
+}
+
+func TestEmulateExecSignaled(t *testing.T) {
+	cmd := helperCommand(t, "emulate", "sh", "-c", "kill -TERM $$")
+	_ = cmd.Run()
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !status.Signaled() || status.Signal() != syscall.SIGTERM {
+		t.Fatalf("expected to be killed by SIGTERM, got %v", cmd.ProcessState)
+	}
+}
+
+func TestEmulateExecForwardsSignals(t *testing.T) {
+	cmd := helperCommand(t, "emulate", "sh", "-c", `trap 'echo got; exit 3' TERM; echo ready; while :; do sleep 0.01; done`)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(stdout)
+	if line, _ := r.ReadString('\n'); line != "ready\n" {
+		t.Fatalf("expected %q, got %q", "ready\n", line)
+	}
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := r.ReadString('\n'); line != "got\n" {
+		t.Fatalf("expected %q, got %q", "got\n", line)
+	}
+	_ = cmd.Wait()
+	if cmd.ProcessState.ExitCode() != 3 {
+		t.Fatalf("expected exit status 3, got %v", cmd.ProcessState)
+	}
+}
+
+func TestExecOrRunFallback(t *testing.T) {
+	cmd := helperCommand(t, "exec-or-run-reader", "cat")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q failed: %v\n%s", cmd, err, out)
+	}
+	if string(out) != "hello\n" {
+		t.Fatalf("expected %q, got %q", "hello\n", out)
+	}
+}
+
+func TestExecStdio(t *testing.T) {
+	for _, tt := range []struct {
+		mode string
+		want string
+	}{
+		{"inherit", "pipe:"},
+		{"null", "/dev/null"},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			var stderr strings.Builder
+			cmd := helperCommand(t, "exec-stdio", tt.mode)
+			cmd.Stdin = strings.NewReader("")
+			cmd.Stdout = io.Discard
+			cmd.Stderr = &stderr
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("%q failed: %v\n%s", cmd, err, stderr.String())
+			}
+			lines := strings.Fields(stderr.String())
+			if len(lines) != 2 || !strings.HasPrefix(lines[0], tt.want) || !strings.HasPrefix(lines[1], tt.want) {
+				t.Fatalf("expected stdin and stdout to be %s, got %q", tt.want, lines)
+			}
+		})
+	}
+}
+
+// connWrapper hides the methods of a connection other than Read and Write, so that
+// only a registered FileUnwrapper can find its file descriptor.
+type connWrapper struct {
+	c *net.TCPConn
+}
+
+func (w connWrapper) Read(p []byte) (int, error)  { return w.c.Read(p) }
+func (w connWrapper) Write(p []byte) (int, error) { return w.c.Write(p) }
+
+func TestExecConnStdio(t *testing.T) {
+	for _, mode := range []string{"conn", "unwrapper"} {
+		t.Run(mode, func(t *testing.T) {
+			var stderr strings.Builder
+			cmd := helperCommand(t, "exec-inetd", mode, "sh", "-c", "read line; echo \"got $line\"")
+			cmd.Stderr = &stderr
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer cmd.Wait()
+			addr, _ := bufio.NewReader(stdout).ReadString('\n')
+
+			conn, err := net.Dial("tcp", strings.TrimSpace(addr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte("hello\n")); err != nil {
+				t.Fatal(err)
+			}
+			out, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != "got hello\n" {
+				t.Fatalf("expected %q, got %q\n%s", "got hello\n", out, stderr.String())
+			}
+		})
+	}
+}
+
+var readerData = bytes.Repeat([]byte("0123456789abcdef\n"), 256*1024)
+
+func TestExecReaderStdin(t *testing.T) {
+	for _, mode := range []string{"known", "unknown"} {
+		t.Run(mode, func(t *testing.T) {
+			var stderr strings.Builder
+			cmd := helperCommand(t, "exec-reader", mode, "cat")
+			cmd.Stderr = &stderr
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("%q failed: %v\n%s", cmd, err, stderr.String())
+			}
+			if !bytes.Equal(out, readerData) {
+				t.Fatalf("expected %d bytes of data, got %d bytes", len(readerData), len(out))
+			}
+		})
+	}
+}
+
+func TestExecReaderStdinSealed(t *testing.T) {
+	var stderr strings.Builder
+	cmd := helperCommand(t, "exec-reader", "known", "sh", "-c", "echo x >>/proc/self/fd/0")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatalf("expected writing to stdin to fail")
+	}
+}
+
+func TestExecReaderStdinTooLarge(t *testing.T) {
+	cmd := helperCommand(t, "exec-reader", "too-large", "cat")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !bytes.Contains(out, []byte("MaxStdinBuffer")) {
+		t.Fatalf("expected Exec to fail because of MaxStdinBuffer, got %v\n%s", err, out)
+	}
+}
+
+func TestExecBufferedStdin(t *testing.T) {
+	data := append([]byte("hello\n"), readerData...)
+	for _, mode := range []string{"bufio", "multi", "fail"} {
+		t.Run(mode, func(t *testing.T) {
+			var stdout bytes.Buffer
+			var stderr strings.Builder
+			cmd := helperCommand(t, "exec-peek", mode, "cat")
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			// Write in pieces so that the helper can only have buffered the first one.
+			_, _ = stdin.Write(data[:len("hello\n")])
+			time.Sleep(10 * time.Millisecond)
+			_, _ = stdin.Write(data[len("hello\n"):])
+			_ = stdin.Close()
+			if err := cmd.Wait(); err != nil {
+				t.Fatalf("%q failed: %v\n%s", cmd, err, stderr.String())
+			}
+			if !bytes.Equal(stdout.Bytes(), data) {
+				t.Fatalf("expected %d bytes of data, got %d bytes\n%s", len(data), stdout.Len(), stderr.String())
+			}
+		})
+	}
+}
+
+func TestExecBufferedStdinError(t *testing.T) {
+	var stderr strings.Builder
+	cmd := helperCommand(t, "exec-peek", "dir", "cat")
+	cmd.Stdin = strings.NewReader("hello\n")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%q failed: %v\n%s", cmd, err, stderr.String())
+	}
+	if string(out) != "hello\n" {
+		t.Fatalf("expected %q, got %q", "hello\n", out)
+	}
+	if !strings.Contains(stderr.String(), "stdin relay") || !strings.Contains(stderr.String(), "is a directory") {
+		t.Fatalf("expected the relay to report an error, got %q", stderr.String())
+	}
+}
+
+func TestExecFdMap(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	for _, name := range []string{a, b} {
+		if err := os.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// readlink fails for the closed file descriptors, which it leaves out.
+	cmd := helperCommand(t, "exec-fd-map", a, b)
+	out, _ := cmd.Output()
+	got := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(got) > 0 && strings.HasPrefix(got[0], "pipe:") {
+		got[0] = "pipe"
+	}
+	want := []string{"pipe", b, a, a}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected file descriptors\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestExecCloseOtherFds(t *testing.T) {
+	out, err := helperCommand(t, "exec-leak", "leak").Output()
+	if err != nil || string(out) != "/dev/null\n" {
+		t.Fatalf("expected the file descriptor to leak, got %q: %v", out, err)
+	}
+	out, err = helperCommand(t, "exec-leak", "close").Output()
+	if err == nil {
+		t.Fatalf("expected the file descriptor to be closed, got %q", out)
+	}
+}
+
+func TestInheritableFds(t *testing.T) {
+	fd, err := unix.Open(os.DevNull, unix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	before := describeFd(fd)
+
+	fds, err := jcbhmrexec.InheritableFds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(fds, fd) {
+		t.Errorf("expected %d in InheritableFds, got %v", fd, fds)
+	}
+
+	attr := &os.ProcAttr{Files: []*os.File{os.Stdin, os.Stdout, os.Stderr}}
+	p, err := jcbhmrexec.PlanProcess("/bin/true", []string{"true"}, attr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(p.LeakedFds, fd) {
+		t.Errorf("expected %d in LeakedFds, got %v", fd, p.LeakedFds)
+	}
+	p, err = jcbhmrexec.PlanProcessWith("/bin/true", []string{"true"}, attr, &jcbhmrexec.ExecOptions{CloseOtherFds: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.LeakedFds) != 0 {
+		t.Errorf("expected no LeakedFds with CloseOtherFds, got %v", p.LeakedFds)
+	}
+
+	// A failed Exec clears the close-on-exec flag again.
+	err = jcbhmrexec.ExecProcessWith("/nonexistent/go-exec-test", []string{"go-exec-test"}, attr, &jcbhmrexec.ExecOptions{CloseOtherFds: true})
+	var execErr *jcbhmrexec.ExecError
+	if !errors.As(err, &execErr) || execErr.Op != "execve" || execErr.Irreversible {
+		t.Fatalf("expected reversible execve *ExecError, got %T: %v", err, err)
+	}
+	if after := describeFd(fd); after != before {
+		t.Errorf("file descriptor %d is %s after a failed Exec, expected %s", fd, after, before)
+	}
+}
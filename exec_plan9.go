@@ -2,10 +2,10 @@ package exec
 
 import (
 	"encoding/binary"
+	"fmt"
 	"os"
 	"slices"
 	"strconv"
-	"sync"
 	"syscall"
 
 	"golang.org/x/sys/plan9"
@@ -14,9 +14,10 @@ import (
 var zeroProcAttr syscall.ProcAttr
 var zeroSysProcAttr syscall.SysProcAttr
 
-var forked sync.Mutex
+// unsupportedSysProcAttrFields are the SysProcAttr fields that execProcess does not honor.
+var unsupportedSysProcAttrFields = []string{"Rfork"}
 
-func execProcess(argv0 string, argv []string, attr *syscall.ProcAttr) (err error) {
+func execProcess(s *execState, argv0 string, argv []string, attr *syscall.ProcAttr) (err error) {
 	if attr == nil {
 		attr = &zeroProcAttr
 	}
@@ -35,41 +36,47 @@ func execProcess(argv0 string, argv []string, attr *syscall.ProcAttr) (err error
 	}
 	nextfd++
 
-	forked.Lock()
-	defer forked.Unlock()
-
-	dupdevfd, err := plan9.Open("#d", plan9.O_RDONLY)
-	if err != nil {
-		return err
-	}
-
-	statbuf := make([]byte, plan9.STATMAX)
-	for {
-		n, err := plan9.Pread(dupdevfd, statbuf, 0)
+	err = s.do("close", "close(#d/*)", func() error {
+		dupdevfd, err := plan9.Open("#d", plan9.O_RDONLY)
 		if err != nil {
 			return err
 		}
-		if n == 0 {
-			break
-		}
-		for b := statbuf[:n]; len(b) > 0; {
-			var s osString
-			s, b = osStringList(b).Dirname()
-			if s == nil {
-				return plan9.ErrBadStat
+
+		statbuf := make([]byte, plan9.STATMAX)
+		for {
+			n, err := plan9.Pread(dupdevfd, statbuf, 0)
+			if err != nil {
+				return err
 			}
-			if s[len(s)-1] == 'l' {
-				continue
+			if n == 0 {
+				break
 			}
-			n, _ := strconv.Atoi(string(s.Bytes()))
-			if n != dupdevfd && !slices.Contains(fd, n) {
-				_ = plan9.Close(n)
+			for b := statbuf[:n]; len(b) > 0; {
+				var name osString
+				name, b = osStringList(b).Dirname()
+				if name == nil {
+					return plan9.ErrBadStat
+				}
+				if name[len(name)-1] == 'l' {
+					continue
+				}
+				n, _ := strconv.Atoi(string(name.Bytes()))
+				if n != dupdevfd && !slices.Contains(fd, n) {
+					_ = plan9.Close(n)
+				}
 			}
 		}
+		_ = plan9.Close(dupdevfd)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	_ = plan9.Close(dupdevfd)
+
 	if attr.Dir != "" {
-		err = os.Chdir(attr.Dir)
+		err = s.do("chdir", fmt.Sprintf("chdir(%q)", attr.Dir), func() error {
+			return os.Chdir(attr.Dir)
+		})
 		if err != nil {
 			return err
 		}
@@ -77,7 +84,10 @@ func execProcess(argv0 string, argv []string, attr *syscall.ProcAttr) (err error
 
 	for i, f := range fd {
 		if f >= 0 && f < i {
-			_, err = plan9.Dup(f, nextfd)
+			err = s.do("dup", fmt.Sprintf("dup(%d, %d)", f, nextfd), func() error {
+				_, err := plan9.Dup(f, nextfd)
+				return err
+			})
 			if err != nil {
 				return err
 			}
@@ -87,13 +97,18 @@ func execProcess(argv0 string, argv []string, attr *syscall.ProcAttr) (err error
 
 	for i, f := range fd {
 		if f == -1 {
-			_ = plan9.Close(i)
+			_ = s.do("close", fmt.Sprintf("close(%d)", i), func() error {
+				return plan9.Close(i)
+			})
 			continue
 		}
 		if f == i {
 			continue
 		}
-		_, err = plan9.Dup(f, i)
+		err = s.do("dup", fmt.Sprintf("dup(%d, %d)", f, i), func() error {
+			_, err := plan9.Dup(f, i)
+			return err
+		})
 		if err != nil {
 			return err
 		}
@@ -101,11 +116,15 @@ func execProcess(argv0 string, argv []string, attr *syscall.ProcAttr) (err error
 
 	for _, f := range fd {
 		if f >= len(attr.Files) {
-			_ = plan9.Close(f)
+			_ = s.do("close", fmt.Sprintf("close(%d)", f), func() error {
+				return plan9.Close(f)
+			})
 		}
 	}
 
-	return syscall.Exec(argv0, argv, attr.Env)
+	return s.do("execve", fmt.Sprintf("exec(%q, %q)", argv0, argv), func() error {
+		return syscall.Exec(argv0, argv, attr.Env)
+	})
 }
 
 type osString []byte
@@ -3,8 +3,13 @@
 package exec_test
 
 import (
+	"errors"
+	"io"
 	"log"
 	"os"
+	"os/exec"
+	"sync"
+	"testing"
 
 	jcbhmrexec "github.com/jcbhmr/go-exec"
 )
@@ -14,3 +19,71 @@ func ExampleExecProcess() {
 		Env: os.Environ(),
 	}))
 }
+
+func TestExecProcessError(t *testing.T) {
+	err := jcbhmrexec.ExecProcess("/nonexistent/go-exec-test", []string{"go-exec-test"}, &os.ProcAttr{
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	var execErr *jcbhmrexec.ExecError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("expected *ExecError, got %T: %v", err, err)
+	}
+	if execErr.Op != "execve" {
+		t.Fatalf("expected Op %q, got %q", "execve", execErr.Op)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %v to wrap %v", err, os.ErrNotExist)
+	}
+}
+
+func TestExecProcessConcurrent(t *testing.T) {
+	// The first Exec is in progress while it buffers Stdin, which it reads until pw
+	// is closed.
+	pr, pw := io.Pipe()
+	stdin := &firstReadNotifier{r: pr, reading: make(chan struct{})}
+	cmd := exec.Command("/nonexistent/go-exec-test")
+	cmd.Stdin = stdin
+	first := make(chan error, 1)
+	go func() {
+		first <- (*jcbhmrexec.CmdExt)(cmd).ExecWith(&jcbhmrexec.ExecOptions{MaxStdinBuffer: 64})
+	}()
+	<-stdin.reading
+
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Go(func() {
+			err := jcbhmrexec.ExecProcess("/nonexistent/go-exec-test", []string{"go-exec-test"}, &os.ProcAttr{
+				Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+			})
+			if err != jcbhmrexec.ErrExecInProgress {
+				t.Errorf("expected ErrExecInProgress, got %T: %v", err, err)
+			}
+		})
+	}
+	wg.Wait()
+
+	pw.Close()
+	var execErr *jcbhmrexec.ExecError
+	if err := <-first; !errors.As(err, &execErr) {
+		t.Fatalf("expected the first Exec to fail with *ExecError, got %T: %v", err, err)
+	}
+	// The first Exec has given up its slot.
+	err := jcbhmrexec.ExecProcess("/nonexistent/go-exec-test", []string{"go-exec-test"}, &os.ProcAttr{
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if !errors.As(err, &execErr) {
+		t.Fatalf("expected *ExecError, got %T: %v", err, err)
+	}
+}
+
+// firstReadNotifier closes reading when r is first read from.
+type firstReadNotifier struct {
+	r       io.Reader
+	once    sync.Once
+	reading chan struct{}
+}
+
+func (n *firstReadNotifier) Read(p []byte) (int, error) {
+	n.once.Do(func() { close(n.reading) })
+	return n.r.Read(p)
+}
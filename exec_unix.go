@@ -13,7 +13,7 @@ import (
 var zeroProcAttr syscall.ProcAttr
 var zeroSysProcAttr unix.SysProcAttr
 
-func execProcess(argv0 string, argv []string, attr *syscall.ProcAttr) error {
+func execProcess(s *execState, argv0 string, argv []string, attr *syscall.ProcAttr) error {
 	if attr == nil {
 		attr = &zeroProcAttr
 	}
@@ -33,6 +33,24 @@ func execProcess(argv0 string, argv []string, attr *syscall.ProcAttr) error {
 		return errors.New("Setctty set but Ctty not valid in child")
 	}
 
+	if sys.Chroot != "" {
+		argv0, attr = inChroot(argv0, attr)
+	}
+
 	// Platform-specific
-	return execProcessUnix(argv0, argv, attr, sys)
+	return execProcessUnix(s, argv0, argv, attr, sys)
+}
+
+// execve is like [syscall.Exec], which restores the RLIMIT_NOFILE soft limit that
+// the Go runtime raised at startup and runs the runtime's before-exec hooks, but it
+// also stops the ITIMER_PROF profiling timer. Unlike the signal handler for SIGPROF,
+// that timer survives execve(2) and would kill the new program.
+func execve(argv0 string, argv []string, envv []string) error {
+	itimer, err := setProfTimer(itimerval{})
+	if err != nil {
+		return err
+	}
+	err = syscall.Exec(argv0, argv, envv)
+	_, _ = setProfTimer(itimer)
+	return err
 }
@@ -0,0 +1,132 @@
+//go:build unix || plan9
+
+package exec
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+)
+
+// mapFiles returns files, which holds a file descriptor of the current process for
+// each file descriptor of the new program, updated with the entries of the Files and
+// Fds of s.opts. The file descriptors that are neither in files nor in those maps are
+// closed, which ^uintptr(0) stands for.
+//
+// A file descriptor of the new program that is not below maxFds couldn't be created,
+// so mapFiles reports it as a failing dup step before allocating a table that large.
+func (s *execState) mapFiles(files []uintptr) ([]uintptr, error) {
+	o := s.opts
+	if len(o.Files) == 0 && len(o.Fds) == 0 {
+		return files, nil
+	}
+
+	n := len(files)
+	limit := maxFds()
+	check := func(i int) error {
+		if i < 0 {
+			return errors.New("exec: negative file descriptor " + strconv.Itoa(i) + " in ExecOptions")
+		}
+		if i >= limit {
+			err := errors.New("file descriptor " + strconv.Itoa(i) + " is not below the limit of " + strconv.Itoa(limit))
+			return &ExecError{Op: "dup", Path: s.path, Args: s.argv, Err: err}
+		}
+		n = max(n, i+1)
+		return nil
+	}
+	for i := range o.Files {
+		if _, ok := o.Fds[i]; ok {
+			return nil, errors.New("exec: file descriptor " + strconv.Itoa(i) + " is in both ExecOptions.Files and ExecOptions.Fds")
+		}
+		if err := check(i); err != nil {
+			return nil, err
+		}
+	}
+	for i, fd := range o.Fds {
+		if err := check(i); err != nil {
+			return nil, err
+		}
+		if fd < -1 {
+			return nil, errors.New("exec: ExecOptions.Fds maps " + strconv.Itoa(i) + " to negative file descriptor " + strconv.Itoa(fd))
+		}
+	}
+
+	mapped := make([]uintptr, n)
+	for i := range mapped {
+		mapped[i] = ^uintptr(0)
+	}
+	copy(mapped, files)
+	for i, f := range o.Files {
+		mapped[i] = f.Fd()
+	}
+	for i, f := range o.Fds {
+		mapped[i] = uintptr(f)
+	}
+	return mapped, nil
+}
+
+// fdOp is a step of rearranging the file descriptors of the current process for the
+// new program. See remapFds.
+type fdOp struct {
+	kind fdOpKind
+	from int
+	to   int
+}
+
+type fdOpKind int
+
+const (
+	// fdOpMove copies from to to and sets the close-on-exec flag of to. It only
+	// moves a file descriptor out of the way of the others.
+	fdOpMove fdOpKind = iota
+	// fdOpDup copies from to to and clears the close-on-exec flag of to.
+	fdOpDup
+	// fdOpInherit clears the close-on-exec flag of to, which is also from.
+	fdOpInherit
+	// fdOpClose closes to.
+	fdOpClose
+)
+
+// remapFds returns the steps that make each file descriptor i of the new program a
+// copy of the file descriptor fd[i] of the current process, or closed if fd[i] is -1.
+// The file descriptors 0, 1 and 2 are closed too if fd doesn't cover them.
+//
+// nextfd must be greater than len(fd) and every element of fd. The file descriptors
+// that are moved out of the way, because a lower file descriptor of the new program
+// would replace them before they are copied where they belong, are placed at nextfd
+// and upwards. remapFds returns the first file descriptor above those.
+//
+// Every copy of a file descriptor happens before it is replaced, even when fd has
+// cycles like [1, 0] or several file descriptors of the new program copy the same
+// one, so the steps can be carried out in order.
+func remapFds(fd []int, nextfd int) (ops []fdOp, end int) {
+	fd = slices.Clone(fd)
+
+	// Step 1: move the file descriptors that would be replaced before they are
+	// copied. Those are exactly the ones that are lower than their destination,
+	// since step 2 goes upwards.
+	for i, f := range fd {
+		if f >= 0 && f < i {
+			ops = append(ops, fdOp{kind: fdOpMove, from: f, to: nextfd})
+			fd[i] = nextfd
+			nextfd++
+		}
+	}
+
+	// Step 2: put each file descriptor in place.
+	for i, f := range fd {
+		switch f {
+		case -1:
+			ops = append(ops, fdOp{kind: fdOpClose, from: -1, to: i})
+		case i:
+			ops = append(ops, fdOp{kind: fdOpInherit, from: i, to: i})
+		default:
+			ops = append(ops, fdOp{kind: fdOpDup, from: f, to: i})
+		}
+	}
+
+	for i := len(fd); i < 3; i++ {
+		ops = append(ops, fdOp{kind: fdOpClose, from: -1, to: i})
+	}
+	return ops, nextfd
+}
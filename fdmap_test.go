@@ -0,0 +1,133 @@
+//go:build unix || plan9
+
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+)
+
+// fakeFd is an entry of the file descriptor table that TestRemapFds simulates.
+type fakeFd struct {
+	file    int
+	cloexec bool
+}
+
+// forEachFdTable calls fn with every fd table of length 0 to n whose elements are -1
+// or a file descriptor below max.
+func forEachFdTable(n int, max int, fn func(fd []int)) {
+	var rec func(fd []int)
+	rec = func(fd []int) {
+		fn(fd)
+		if len(fd) == n {
+			return
+		}
+		for f := -1; f < max; f++ {
+			rec(append(fd, f))
+		}
+	}
+	rec(nil)
+}
+
+func TestRemapFds(t *testing.T) {
+	forEachFdTable(5, 7, func(fd []int) {
+		nextfd := len(fd)
+		for _, f := range fd {
+			nextfd = max(nextfd, f)
+		}
+		nextfd++
+
+		// Every file descriptor starts out open and close-on-exec, including the
+		// ones that moved file descriptors are placed at, so that clobbering or
+		// leaking any of them shows.
+		table := map[int]fakeFd{}
+		for i := range nextfd + len(fd) + 3 {
+			table[i] = fakeFd{file: i, cloexec: true}
+		}
+
+		ops, end := remapFds(fd, nextfd)
+		name := fmt.Sprint(fd)
+		for _, op := range ops {
+			switch op.kind {
+			case fdOpMove, fdOpDup:
+				from, ok := table[op.from]
+				if !ok {
+					t.Fatalf("%s: %+v copies a closed file descriptor", name, op)
+				}
+				if op.kind == fdOpMove && (op.to < nextfd || op.to >= end) {
+					t.Fatalf("%s: %+v moves a file descriptor outside of [%d, %d)", name, op, nextfd, end)
+				}
+				table[op.to] = fakeFd{file: from.file, cloexec: op.kind == fdOpMove}
+			case fdOpInherit:
+				f, ok := table[op.to]
+				if !ok {
+					t.Fatalf("%s: %+v inherits a closed file descriptor", name, op)
+				}
+				table[op.to] = fakeFd{file: f.file}
+			case fdOpClose:
+				delete(table, op.to)
+			}
+		}
+
+		for i := range max(len(fd), 3) {
+			f, ok := table[i]
+			switch {
+			case i >= len(fd) || fd[i] == -1:
+				if ok {
+					t.Fatalf("%s: file descriptor %d is open, ops %+v", name, i, ops)
+				}
+			case !ok || f.file != fd[i] || f.cloexec:
+				t.Fatalf("%s: file descriptor %d is %+v (open: %t), want file %d, ops %+v", name, i, f, ok, fd[i], ops)
+			}
+		}
+		for i, f := range table {
+			if i >= max(len(fd), 3) && !f.cloexec {
+				t.Fatalf("%s: file descriptor %d leaks into the new program, ops %+v", name, i, ops)
+			}
+			if i >= nextfd && i < end && !slices.ContainsFunc(ops, func(op fdOp) bool { return op.to == i }) {
+				t.Fatalf("%s: %d is in the range of moved file descriptors but wasn't moved", name, i)
+			}
+		}
+	})
+}
+
+func TestMapFiles(t *testing.T) {
+	closed := ^uintptr(0)
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, tt := range []struct {
+		opts  ExecOptions
+		files []uintptr
+		want  []uintptr
+		err   bool
+	}{
+		{ExecOptions{}, []uintptr{0, 1, 2}, []uintptr{0, 1, 2}, false},
+		{ExecOptions{Fds: map[int]int{5: 7}}, []uintptr{0, 1, 2}, []uintptr{0, 1, 2, closed, closed, 7}, false},
+		{ExecOptions{Fds: map[int]int{1: -1}}, []uintptr{0, 1, 2}, []uintptr{0, closed, 2}, false},
+		{ExecOptions{Files: map[int]*os.File{0: f, 4: nil}}, []uintptr{0, 1, 2}, []uintptr{f.Fd(), 1, 2, closed, closed}, false},
+		{ExecOptions{Files: map[int]*os.File{3: f}, Fds: map[int]int{3: 3}}, nil, nil, true},
+		{ExecOptions{Fds: map[int]int{-1: 3}}, nil, nil, true},
+		{ExecOptions{Fds: map[int]int{3: -2}}, nil, nil, true},
+		{ExecOptions{Fds: map[int]int{1 << 30: 3}}, nil, nil, true},
+		{ExecOptions{Files: map[int]*os.File{1 << 30: f}}, nil, nil, true},
+	} {
+		got, err := newExecState("/bin/true", nil, &tt.opts).mapFiles(tt.files)
+		if (err != nil) != tt.err || !slices.Equal(got, tt.want) {
+			t.Errorf("%+v.mapFiles(%v) = %v, %v; want %v (error: %t)", tt.opts, tt.files, got, err, tt.want, tt.err)
+		}
+	}
+
+	// A file descriptor beyond the limit fails like the dup step that would create it.
+	s := newExecState("/bin/true", nil, &ExecOptions{Fds: map[int]int{1 << 30: 3}})
+	_, err = s.mapFiles(nil)
+	var execErr *ExecError
+	if !errors.As(err, &execErr) || execErr.Op != "dup" {
+		t.Errorf("expected an *ExecError for the dup step, got %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build linux
+
+package exec
+
+import "golang.org/x/sys/unix"
+
+// fdDir lists the open file descriptors of the current process.
+const fdDir = "/proc/self/fd"
+
+const closeRangeCall = "close_range(%d, ~0U, CLOSE_RANGE_CLOEXEC)"
+
+// closeRangeCloexec sets the close-on-exec flag of every file descriptor from first
+// upwards with close_range(2), which fails on kernels older than 5.11.
+func closeRangeCloexec(first int) error {
+	return unix.CloseRange(uint(first), ^uint(0), unix.CLOSE_RANGE_CLOEXEC)
+}
@@ -0,0 +1,16 @@
+//go:build unix && !linux
+
+package exec
+
+import "golang.org/x/sys/unix"
+
+// fdDir lists the open file descriptors of the current process.
+const fdDir = "/dev/fd"
+
+const closeRangeCall = "fcntl(%d..., F_SETFD, FD_CLOEXEC)"
+
+// closeRangeCloexec always fails, so that the file descriptors in fdDir are marked
+// one by one instead.
+func closeRangeCloexec(first int) error {
+	return unix.ENOSYS
+}
@@ -0,0 +1,15 @@
+//go:build plan9
+
+package exec
+
+// leakedFds returns nil: on Plan 9, the new program never inherits any file
+// descriptor other than its files.
+func leakedFds(n int, opts *ExecOptions) []int {
+	return nil
+}
+
+// maxFds returns a bound on the file descriptors of the new program. Plan 9 has no
+// limit on them, so the bound only keeps a huge one from exhausting memory.
+func maxFds() int {
+	return 1 << 16
+}
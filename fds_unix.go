@@ -0,0 +1,101 @@
+//go:build unix
+
+package exec
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// InheritableFds returns the open file descriptors of the current process that
+// don't have the close-on-exec flag set, in increasing order.
+//
+// The new program that [ExecProcess] or [CmdExt.Exec] replaces the current process
+// with inherits those that it doesn't get as one of its own files, unless
+// [ExecOptions.CloseOtherFds] is set. [ExecPlan.LeakedFds] lists them for a
+// particular command.
+func InheritableFds() ([]int, error) {
+	entries, err := os.ReadDir(fdDir)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for _, entry := range entries {
+		fd, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+		if err != nil || flags&unix.FD_CLOEXEC != 0 {
+			// Closed since, like the file descriptor that read the directory.
+			continue
+		}
+		fds = append(fds, fd)
+	}
+	slices.Sort(fds)
+	return fds, nil
+}
+
+// leakedFds returns the file descriptors that the new program would inherit although
+// they aren't one of its n files.
+func leakedFds(n int, opts *ExecOptions) []int {
+	if opts.CloseOtherFds {
+		return nil
+	}
+	fds, err := InheritableFds()
+	if err != nil {
+		return nil
+	}
+	return slices.DeleteFunc(fds, func(fd int) bool {
+		return fd < max(n, 3)
+	})
+}
+
+// closeOtherFds is the step that sets the close-on-exec flag of every file
+// descriptor from first upwards. See [ExecOptions.CloseOtherFds].
+func closeOtherFds(s *execState, first int) error {
+	return s.doReversible("close", fmt.Sprintf(closeRangeCall, first), func() (func(), error) {
+		// Rolling back needs to know which file descriptors didn't have the flag.
+		fds, listErr := InheritableFds()
+		fds = slices.DeleteFunc(fds, func(fd int) bool { return fd < first })
+		var undo func()
+		if listErr == nil {
+			undo = func() {
+				for _, fd := range fds {
+					_, _ = unix.FcntlInt(uintptr(fd), unix.F_SETFD, 0)
+				}
+			}
+		}
+
+		err := closeRangeCloexec(first)
+		if err == nil {
+			return undo, nil
+		}
+		if listErr != nil {
+			return nil, listErr
+		}
+		for _, fd := range fds {
+			_, err := unix.FcntlInt(uintptr(fd), unix.F_SETFD, unix.FD_CLOEXEC)
+			if err != nil && err != unix.EBADF {
+				undo()
+				return nil, err
+			}
+		}
+		return undo, nil
+	})
+}
+
+// maxFds returns the RLIMIT_NOFILE soft limit, which the file descriptors of the new
+// program have to be below.
+func maxFds() int {
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim); err != nil {
+		return math.MaxInt32
+	}
+	return int(min(rlim.Cur, math.MaxInt32))
+}
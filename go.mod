@@ -2,4 +2,4 @@ module github.com/jcbhmr/go-exec
 
 go 1.25.4
 
-require golang.org/x/sys v0.40.0 // indirect
+require golang.org/x/sys v0.40.0
@@ -0,0 +1,8 @@
+// Package constructor tells package exec whether the constructor of package nsenter
+// is linked into the program.
+package constructor
+
+// Linked reports whether the constructor of package nsenter, which enters
+// namespaces before the Go runtime starts any threads, is linked in. Package nsenter
+// sets it when it is initialized.
+var Linked bool
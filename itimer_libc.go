@@ -0,0 +1,12 @@
+//go:build aix || solaris
+
+package exec
+
+// itimerval stands for struct itimerval of setitimer(2).
+type itimerval struct{}
+
+// setProfTimer leaves the ITIMER_PROF timer alone: there is no way to call
+// setitimer(2) here without cgo.
+func setProfTimer(it itimerval) (itimerval, error) {
+	return itimerval{}, nil
+}
@@ -0,0 +1,30 @@
+//go:build unix && !aix && !solaris
+
+package exec
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// itimerval is struct itimerval of setitimer(2).
+type itimerval struct {
+	interval unix.Timeval
+	value    unix.Timeval
+}
+
+// itimerProf is ITIMER_PROF, which has the same value on every platform.
+const itimerProf = 2
+
+// setProfTimer sets the ITIMER_PROF timer of the current process to it and returns
+// its previous value.
+func setProfTimer(it itimerval) (itimerval, error) {
+	var old itimerval
+	_, _, err := syscall.Syscall(unix.SYS_SETITIMER, itimerProf, uintptr(unsafe.Pointer(&it)), uintptr(unsafe.Pointer(&old)))
+	if err != 0 {
+		return itimerval{}, err
+	}
+	return old, nil
+}
@@ -0,0 +1,138 @@
+//go:build unix
+
+package exec
+
+import (
+	"cmp"
+	"errors"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenFdsStart is the first file descriptor passed with the socket activation
+// protocol, SD_LISTEN_FDS_START in sd_listen_fds(3).
+const listenFdsStart = 3
+
+// ListenFd is a file descriptor passed from one program to the next with the socket
+// activation protocol of systemd. See sd_listen_fds(3).
+type ListenFd struct {
+	// Name is the name of the file descriptor, as in FileDescriptorName= of
+	// systemd.socket(5). It can't contain a colon. An empty Name stands for
+	// "unknown".
+	Name string
+
+	// File is the file descriptor. [CmdExt.SetListenFds] accepts an [*os.File], a
+	// [net.Listener] like [*net.TCPListener], or any other value with a file
+	// descriptor that [CmdExt.Exec] accepts as Stdin. [ListenFds] always sets File
+	// to an *os.File.
+	File any
+}
+
+// SetListenFds sets up c to pass fds to the new program with the socket activation
+// protocol of systemd, like a socket unit does. It makes fds the ExtraFiles of c, so
+// that they get the file descriptors 3 and up, and sets LISTEN_FDS, LISTEN_PID and
+// LISTEN_FDNAMES in the environment of c, replacing any that are already set.
+//
+// LISTEN_PID is set to the process ID of the current process, which the new program
+// keeps when c is run with [CmdExt.Exec]. A program started as a child process by
+// [os/exec.Cmd.Start] ignores the file descriptors because of that.
+//
+// The new program gets the file descriptors in blocking mode, which they share with
+// the ones that they were duplicated from. If [CmdExt.Exec] fails, it makes them
+// non-blocking again, so that a [net.Listener] keeps working.
+func (c *CmdExt) SetListenFds(fds ...ListenFd) error {
+	for _, fd := range fds {
+		if strings.Contains(fd.Name, ":") {
+			return errors.New("exec: listen fd name " + strconv.Quote(fd.Name) + " contains a colon")
+		}
+	}
+
+	files := make([]*os.File, 0, len(fds))
+	names := make([]string, 0, len(fds))
+	opened := &stdioFiles{}
+	var nonblocking []*os.File
+	for _, fd := range fds {
+		n := len(opened.restore)
+		f, err := opened.fdFile(fd.File)
+		if err == nil && f == nil {
+			err = errors.New("no file descriptor")
+		}
+		if err != nil {
+			opened.Close()
+			return errors.New("exec: listen fd " + strconv.Quote(fd.Name) + ": " + err.Error())
+		}
+		if len(opened.restore) > n {
+			nonblocking = append(nonblocking, f)
+		}
+		files = append(files, f)
+		names = append(names, cmp.Or(fd.Name, "unknown"))
+	}
+	// Exec makes these non-blocking again if it fails.
+	for _, f := range nonblocking {
+		addNonblockingDup(f)
+	}
+
+	env := slices.DeleteFunc((*exec.Cmd)(c).Environ(), isListenEnv)
+	c.Env = append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(fds)),
+		"LISTEN_PID="+strconv.Itoa(os.Getpid()),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+	)
+	c.ExtraFiles = files
+	return nil
+}
+
+// ListenFds returns the file descriptors passed to the current process with the
+// socket activation protocol of systemd, like sd_listen_fds_with_names(3). It
+// returns nil if there are none, or if LISTEN_PID names another process.
+//
+// ListenFds sets the close-on-exec flag of the file descriptors and unsets
+// LISTEN_FDS, LISTEN_PID and LISTEN_FDNAMES, so that they aren't passed on to
+// processes that the current process starts.
+func ListenFds() ([]ListenFd, error) {
+	pid := os.Getenv("LISTEN_PID")
+	n := os.Getenv("LISTEN_FDS")
+	names := os.Getenv("LISTEN_FDNAMES")
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid == "" || n == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil || count < 0 {
+		return nil, errors.New("exec: invalid LISTEN_FDS " + strconv.Quote(n))
+	}
+
+	var nameList []string
+	if names != "" {
+		nameList = strings.Split(names, ":")
+	}
+	fds := make([]ListenFd, count)
+	for i := range fds {
+		fd := listenFdsStart + i
+		unix.CloseOnExec(fd)
+		name := "unknown"
+		if i < len(nameList) {
+			name = nameList[i]
+		}
+		fds[i] = ListenFd{Name: name, File: os.NewFile(uintptr(fd), name)}
+	}
+	return fds, nil
+}
+
+func isListenEnv(kv string) bool {
+	name, _, _ := strings.Cut(kv, "=")
+	return name == "LISTEN_FDS" || name == "LISTEN_PID" || name == "LISTEN_FDNAMES"
+}
@@ -0,0 +1,181 @@
+//go:build unix
+
+package exec_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	jcbhmrexec "github.com/jcbhmr/go-exec"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	helpers["exec-listen"] = func(args []string) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(ln.Addr())
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "listen-echo")
+		cmd.Env = append(os.Environ(), "LISTEN_FDS=7", "LISTEN_FDNAMES=stale")
+		err = (*jcbhmrexec.CmdExt)(cmd).SetListenFds(jcbhmrexec.ListenFd{Name: "echo", File: ln})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = (*jcbhmrexec.CmdExt)(cmd).Exec()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	helpers["listen-echo"] = func(args []string) {
+		fds, err := jcbhmrexec.ListenFds()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if len(fds) != 1 || fds[0].Name != "echo" {
+			fmt.Fprintf(os.Stderr, "expected one listen fd named echo, got %+v\n", fds)
+			os.Exit(1)
+		}
+		if v, ok := os.LookupEnv("LISTEN_FDS"); ok {
+			fmt.Fprintf(os.Stderr, "LISTEN_FDS=%s is still set\n", v)
+			os.Exit(1)
+		}
+		ln, err := net.FileListener(fds[0].File.(*os.File))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+		os.Exit(0)
+	}
+}
+
+func TestSetListenFds(t *testing.T) {
+	var stderr strings.Builder
+	cmd := helperCommand(t, "exec-listen")
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := bufio.NewReader(stdout).ReadString('\n')
+
+	conn, err := net.Dial("tcp", strings.TrimSpace(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%q failed: %v\n%s", cmd, err, stderr.String())
+	}
+	if string(out) != "hello\n" {
+		t.Fatalf("expected %q, got %q\n%s", "hello\n", out, stderr.String())
+	}
+}
+
+func TestListenFdsOtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", fmt.Sprint(os.Getppid()))
+	t.Setenv("LISTEN_FDS", "1")
+	fds, err := jcbhmrexec.ListenFds()
+	if err != nil || fds != nil {
+		t.Fatalf("expected no listen fds, got %+v, %v", fds, err)
+	}
+	if _, ok := os.LookupEnv("LISTEN_PID"); ok {
+		t.Fatal("expected LISTEN_PID to be unset")
+	}
+}
+
+func TestSetListenFdsName(t *testing.T) {
+	cmd := exec.Command("true")
+	err := (*jcbhmrexec.CmdExt)(cmd).SetListenFds(jcbhmrexec.ListenFd{Name: "a:b", File: os.Stdin})
+	if err == nil {
+		t.Fatal("expected a name with a colon to be an error")
+	}
+}
+
+func TestSetListenFdsExecFails(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cmd := exec.Command("/nonexistent/go-exec-test")
+	err = (*jcbhmrexec.CmdExt)(cmd).SetListenFds(jcbhmrexec.ListenFd{Name: "ln", File: ln})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (*jcbhmrexec.CmdExt)(cmd).Exec(); err == nil {
+		t.Fatal("expected Exec to fail")
+	}
+	for _, f := range cmd.ExtraFiles {
+		_ = f.Close()
+	}
+	checkNonblocking(t, ln)
+}
+
+// checkNonblocking checks that ln is still non-blocking, so that Close interrupts
+// Accept.
+func checkNonblocking(t *testing.T, ln net.Listener) {
+	t.Helper()
+	rc, err := ln.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flags int
+	var ferr error
+	if err := rc.Control(func(fd uintptr) {
+		flags, ferr = unix.FcntlInt(fd, unix.F_GETFL, 0)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	if flags&unix.O_NONBLOCK == 0 {
+		t.Error("the listener is in blocking mode")
+	}
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		accepted <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_ = ln.Close()
+	select {
+	case err := <-accepted:
+		if err == nil {
+			t.Error("expected Accept to fail after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't interrupt Accept")
+	}
+}
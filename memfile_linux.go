@@ -0,0 +1,34 @@
+//go:build linux
+
+package exec
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// memFile returns a new anonymous file that can be read and written. It is a memfd
+// if the kernel supports memfd_create(2), and an O_TMPFILE file otherwise.
+func memFile(name string) (*os.File, error) {
+	fd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err == nil {
+		return os.NewFile(uintptr(fd), "memfd:"+name), nil
+	}
+	fd, err2 := unix.Open(os.TempDir(), unix.O_TMPFILE|unix.O_RDWR|unix.O_CLOEXEC, 0o600)
+	if err2 != nil {
+		return nil, errors.Join(err, err2)
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// sealFile prevents any further change to the contents of a file returned by
+// memFile. It does nothing for an O_TMPFILE file, which can't be sealed.
+func sealFile(f *os.File) error {
+	_, err := unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, unix.F_SEAL_SEAL|unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE)
+	if err == unix.EINVAL {
+		return nil
+	}
+	return err
+}
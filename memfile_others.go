@@ -0,0 +1,21 @@
+//go:build (unix && !linux) || plan9
+
+package exec
+
+import "os"
+
+// memFile returns a new anonymous file that can be read and written. It is a
+// temporary file that has already been removed.
+func memFile(name string) (*os.File, error) {
+	f, err := os.CreateTemp("", "go-exec-"+name+"-")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(f.Name())
+	return f, nil
+}
+
+// sealFile does nothing; only Linux can seal files.
+func sealFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,39 @@
+//go:build unix || plan9
+
+package exec
+
+// Mount is a step of setting up the mount namespace of the new program. See
+// [ExecOptions.Mounts].
+type Mount struct {
+	// Type is the type of the file system to mount at Target, like "tmpfs", "proc",
+	// "sysfs", "devpts" or "mqueue", or one of these:
+	//
+	//   - "bind" makes Source visible at Target too.
+	//   - "dev" mounts a tmpfs at Target with the device nodes null, zero, full,
+	//     random, urandom and tty, the pts and shm directories, and the usual
+	//     symbolic links, like fd and ptmx. In a user namespace, the device nodes are
+	//     bind mounts of the ones in /dev, since they can't be created there.
+	//   - "mask" hides Target, if it exists, behind an empty read-only tmpfs if it is
+	//     a directory, or behind /dev/null if it isn't. Masking a path that doesn't
+	//     exist does nothing.
+	Type string
+
+	// Source is the file or directory to bind mount, or the device or name to
+	// mount. If Source is empty, it is the same as Type.
+	Source string
+
+	// Target is where to mount. Directories are created for it as needed, and if
+	// Source is a file to bind mount, an empty file.
+	Target string
+
+	// ReadOnly mounts the file system read-only.
+	ReadOnly bool
+
+	// Recursive makes a bind mount include the mounts below Source.
+	Recursive bool
+
+	// Data holds file system specific options, like "size=64m,mode=1777" for a tmpfs.
+	// An empty Data for a proc, sysfs, tmpfs or devpts file system gives the usual
+	// options for a container.
+	Data string
+}
@@ -0,0 +1,335 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountFlagNames are the names of the mount(2) flags that mountCall renders.
+var mountFlagNames = []struct {
+	flag uintptr
+	name string
+}{
+	{unix.MS_RDONLY, "MS_RDONLY"},
+	{unix.MS_NOSUID, "MS_NOSUID"},
+	{unix.MS_NODEV, "MS_NODEV"},
+	{unix.MS_NOEXEC, "MS_NOEXEC"},
+	{unix.MS_REMOUNT, "MS_REMOUNT"},
+	{unix.MS_BIND, "MS_BIND"},
+	{unix.MS_REC, "MS_REC"},
+	{unix.MS_PRIVATE, "MS_PRIVATE"},
+	{unix.MS_SLAVE, "MS_SLAVE"},
+	{unix.MS_NOATIME, "MS_NOATIME"},
+	{unix.MS_NODIRATIME, "MS_NODIRATIME"},
+	{unix.MS_RELATIME, "MS_RELATIME"},
+}
+
+// mountCall renders a call to mount(2) for an ExecStep.
+func mountCall(source string, target string, fstype string, flags uintptr, data string) string {
+	var names []string
+	for _, f := range mountFlagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, "0")
+	}
+	return fmt.Sprintf("mount(%q, %q, %q, %s, %q)", source, target, fstype, strings.Join(names, "|"), data)
+}
+
+// mount is like [unix.Mount], but returns an [*os.PathError].
+func mount(source string, target string, fstype string, flags uintptr, data string) error {
+	err := unix.Mount(source, target, fstype, flags, data)
+	if err != nil {
+		return &os.PathError{Op: "mount", Path: target, Err: err}
+	}
+	return nil
+}
+
+// applyMounts carries out mounts as steps of s.
+func applyMounts(s *execState, mounts []Mount) error {
+	for _, m := range mounts {
+		var err error
+		switch m.Type {
+		case "bind":
+			err = bindMount(s, m)
+		case "dev":
+			err = devMount(s, m)
+		case "mask":
+			err = maskMount(s, m)
+		default:
+			err = fsMount(s, m)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsMount mounts a file system of type m.Type.
+func fsMount(s *execState, m Mount) error {
+	source := m.Source
+	if source == "" {
+		source = m.Type
+	}
+	var flags uintptr
+	data := m.Data
+	switch m.Type {
+	case "proc", "sysfs":
+		flags = unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC
+	case "tmpfs":
+		flags = unix.MS_NOSUID | unix.MS_NODEV
+		if data == "" {
+			data = "mode=755"
+		}
+	case "devpts":
+		flags = unix.MS_NOSUID | unix.MS_NOEXEC
+		if data == "" {
+			data = "newinstance,ptmxmode=0666,mode=0620"
+		}
+	}
+	if m.ReadOnly {
+		flags |= unix.MS_RDONLY
+	}
+	return s.do("mount", mountCall(source, m.Target, m.Type, flags, data), func() error {
+		err := os.MkdirAll(m.Target, 0o755)
+		if err != nil {
+			return err
+		}
+		return mount(source, m.Target, m.Type, flags, data)
+	})
+}
+
+// bindMount bind mounts m.Source at m.Target, and remounts it read-only if
+// m.ReadOnly is set.
+func bindMount(s *execState, m Mount) error {
+	flags := uintptr(unix.MS_BIND)
+	if m.Recursive {
+		flags |= unix.MS_REC
+	}
+	err := s.do("mount", mountCall(m.Source, m.Target, "", flags, ""), func() error {
+		err := createTarget(m.Source, m.Target)
+		if err != nil {
+			return err
+		}
+		return mount(m.Source, m.Target, "", flags, "")
+	})
+	if err != nil || !m.ReadOnly {
+		return err
+	}
+	return remountReadOnly(s, m.Target, flags)
+}
+
+// remountReadOnly makes the bind mount at target read-only. The flags that the
+// mount already has are kept, since a user namespace may not clear them.
+func remountReadOnly(s *execState, target string, flags uintptr) error {
+	flags |= unix.MS_REMOUNT | unix.MS_RDONLY
+	return s.do("mount", mountCall("", target, "", flags, ""), func() error {
+		var st unix.Statfs_t
+		err := unix.Statfs(target, &st)
+		if err != nil {
+			return &os.PathError{Op: "statfs", Path: target, Err: err}
+		}
+		for _, f := range []struct{ st, ms uintptr }{
+			{unix.ST_NOSUID, unix.MS_NOSUID},
+			{unix.ST_NODEV, unix.MS_NODEV},
+			{unix.ST_NOEXEC, unix.MS_NOEXEC},
+			{unix.ST_NOATIME, unix.MS_NOATIME},
+			{unix.ST_NODIRATIME, unix.MS_NODIRATIME},
+			{unix.ST_RELATIME, unix.MS_RELATIME},
+		} {
+			if uintptr(st.Flags)&f.st != 0 {
+				flags |= f.ms
+			}
+		}
+		return mount("", target, "", flags, "")
+	})
+}
+
+// createTarget creates target as a directory if source is one, and as an empty
+// file otherwise, unless it exists.
+func createTarget(source string, target string) error {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return os.MkdirAll(target, 0o755)
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_RDONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// devNodes are the device nodes that devMount creates.
+var devNodes = []struct {
+	name         string
+	major, minor uint32
+}{
+	{"null", 1, 3},
+	{"zero", 1, 5},
+	{"full", 1, 7},
+	{"random", 1, 8},
+	{"urandom", 1, 9},
+	{"tty", 5, 0},
+}
+
+// devLinks are the symbolic links that devMount creates, by name.
+var devLinks = [][2]string{
+	{"fd", "/proc/self/fd"},
+	{"stdin", "/proc/self/fd/0"},
+	{"stdout", "/proc/self/fd/1"},
+	{"stderr", "/proc/self/fd/2"},
+	{"ptmx", "pts/ptmx"},
+}
+
+// devMount mounts a minimal /dev at m.Target.
+func devMount(s *execState, m Mount) error {
+	const flags = unix.MS_NOSUID | unix.MS_NOEXEC
+	const data = "mode=755,size=65536k"
+	err := s.do("mount", mountCall("tmpfs", m.Target, "tmpfs", flags, data), func() error {
+		err := os.MkdirAll(m.Target, 0o755)
+		if err != nil {
+			return err
+		}
+		return mount("tmpfs", m.Target, "tmpfs", flags, data)
+	})
+	if err != nil {
+		return err
+	}
+	for _, n := range devNodes {
+		path := filepath.Join(m.Target, n.name)
+		err := s.do("mknod", fmt.Sprintf("mknod(%q, S_IFCHR|0666, makedev(%d, %d))", path, n.major, n.minor), func() error {
+			err := unix.Mknod(path, unix.S_IFCHR|0o666, int(unix.Mkdev(n.major, n.minor)))
+			if errors.Is(err, unix.EPERM) {
+				// Device nodes can't be created in a user namespace.
+				return bindDevice(filepath.Join("/dev", n.name), path)
+			}
+			if err != nil {
+				return &os.PathError{Op: "mknod", Path: path, Err: err}
+			}
+			return os.Chmod(path, 0o666)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, dir := range []string{"pts", "shm"} {
+		path := filepath.Join(m.Target, dir)
+		err := s.do("mkdir", fmt.Sprintf("mkdir(%q)", path), func() error {
+			return os.Mkdir(path, 0o755)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, l := range devLinks {
+		path := filepath.Join(m.Target, l[0])
+		err := s.do("symlink", fmt.Sprintf("symlink(%q, %q)", l[1], path), func() error {
+			return os.Symlink(l[1], path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if m.ReadOnly {
+		const remount = flags | unix.MS_REMOUNT | unix.MS_RDONLY
+		return s.do("mount", mountCall("tmpfs", m.Target, "tmpfs", remount, data), func() error {
+			return mount("tmpfs", m.Target, "tmpfs", remount, data)
+		})
+	}
+	return nil
+}
+
+// bindDevice bind mounts the device node source at target, which it creates.
+func bindDevice(source string, target string) error {
+	f, err := os.OpenFile(target, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return mount(source, target, "", unix.MS_BIND, "")
+}
+
+// maskMount hides m.Target, if it exists.
+func maskMount(s *execState, m Mount) error {
+	return s.do("mount", fmt.Sprintf("mask(%q)", m.Target), func() error {
+		fi, err := os.Stat(m.Target)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return mount("tmpfs", m.Target, "tmpfs", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "size=0")
+		}
+		return mount("/dev/null", m.Target, "", unix.MS_BIND, "")
+	})
+}
+
+// pivotRoot makes root the root directory and unmounts the old one. The working
+// directory is the new root directory afterward.
+func pivotRoot(s *execState, root string) error {
+	// pivot_root(2) needs the new root directory to be a mount point.
+	err := s.do("mount", mountCall(root, root, "", unix.MS_BIND|unix.MS_REC, ""), func() error {
+		return mount(root, root, "", unix.MS_BIND|unix.MS_REC, "")
+	})
+	if err != nil {
+		return err
+	}
+	// Stacking the old root directory on top of the new one saves creating a
+	// directory for it, which root may not allow. The working directory is the old
+	// root directory afterward.
+	err = s.do("pivot_root", fmt.Sprintf("pivot_root(%q, %q)", root, root), func() error {
+		oldroot, err := unix.Open("/", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: "/", Err: err}
+		}
+		defer unix.Close(oldroot)
+		err = unix.Chdir(root)
+		if err != nil {
+			return &os.PathError{Op: "chdir", Path: root, Err: err}
+		}
+		err = unix.PivotRoot(".", ".")
+		if err != nil {
+			return err
+		}
+		return unix.Fchdir(oldroot)
+	})
+	if err != nil {
+		return err
+	}
+	err = s.do("mount", mountCall("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""), func() error {
+		return mount("", ".", "", unix.MS_SLAVE|unix.MS_REC, "")
+	})
+	if err != nil {
+		return err
+	}
+	err = s.do("mount", `umount2("/", MNT_DETACH)`, func() error {
+		err := unix.Unmount(".", unix.MNT_DETACH)
+		if err != nil {
+			return &os.PathError{Op: "umount2", Path: "/", Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.do("chdir", `chdir("/")`, func() error {
+		return unix.Chdir("/")
+	})
+}
@@ -0,0 +1,21 @@
+//go:build unix || plan9
+
+package exec
+
+// Namespace is an existing Linux namespace, or a set of them, for the new program
+// to enter with setns(2). See [ExecOptions.Namespaces].
+type Namespace struct {
+	// Path is a namespace file, like /proc/1234/ns/net or a bind mount of one.
+	Path string
+
+	// UsePidFD makes the new program enter the namespaces of the process that PidFD
+	// refers to instead, which is a pidfd from pidfd_open(2) or from clone(2) with
+	// CLONE_PIDFD. Exec leaves PidFD open.
+	UsePidFD bool
+	PidFD    int
+
+	// Type holds CLONE_NEW* flags, like syscall.CLONE_NEWNET. For a pidfd, it
+	// selects the namespaces of the process to enter and can't be zero. For Path,
+	// it is the type that the namespace must have, or zero for any type.
+	Type uintptr
+}
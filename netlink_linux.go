@@ -0,0 +1,76 @@
+package exec
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setLinkUp brings up the network interface called name in the network namespace
+// of the calling thread, like ip link set name up, with an RTM_NEWLINK request over
+// a netlink socket.
+func setLinkUp(name string) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer unix.Close(fd)
+
+	// struct nlmsghdr, struct ifinfomsg, and an IFLA_IFNAME attribute, since the
+	// interface index is zero.
+	ifname := append([]byte(name), 0)
+	attrLen := unix.SizeofRtAttr + len(ifname)
+	msg := make([]byte, unix.SizeofNlMsghdr+unix.SizeofIfInfomsg+nlmAlign(attrLen))
+	b := binary.NativeEndian
+	b.PutUint32(msg[0:], uint32(len(msg)))
+	b.PutUint16(msg[4:], unix.RTM_NEWLINK)
+	b.PutUint16(msg[6:], unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	b.PutUint32(msg[8:], 1)
+	ifi := msg[unix.SizeofNlMsghdr:]
+	ifi[0] = unix.AF_UNSPEC
+	b.PutUint32(ifi[8:], unix.IFF_UP)
+	b.PutUint32(ifi[12:], unix.IFF_UP)
+	attr := ifi[unix.SizeofIfInfomsg:]
+	b.PutUint16(attr[0:], uint16(attrLen))
+	b.PutUint16(attr[2:], unix.IFLA_IFNAME)
+	copy(attr[unix.SizeofRtAttr:], ifname)
+
+	err = unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != unix.NLMSG_ERROR || m.Header.Seq != 1 {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errors.New("short netlink acknowledgement")
+			}
+			if errno := int32(b.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// nlmAlign rounds n up to the alignment of netlink messages and attributes.
+func nlmAlign(n int) int {
+	return (n + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+}
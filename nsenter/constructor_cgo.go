@@ -0,0 +1,284 @@
+//go:build linux && cgo
+
+package nsenter
+
+/*
+#define _GNU_SOURCE
+#include <errno.h>
+#include <fcntl.h>
+#include <sched.h>
+#include <signal.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/ioctl.h>
+#include <sys/syscall.h>
+#include <sys/types.h>
+#include <sys/wait.h>
+#include <unistd.h>
+
+// go_exec_write_proc writes data to /proc/<pid>/<name>. It returns 0 or an errno
+// value.
+static int go_exec_write_proc(pid_t pid, const char *name, const char *data) {
+	char path[64];
+	snprintf(path, sizeof path, "/proc/%d/%s", (int)pid, name);
+	int fd = open(path, O_WRONLY | O_CLOEXEC);
+	if (fd < 0) {
+		return errno;
+	}
+	size_t len = strlen(data);
+	ssize_t n = write(fd, data, len);
+	int err = n < 0 ? errno : (size_t)n != len ? EIO : 0;
+	close(fd);
+	return err;
+}
+
+static void go_exec_fail(const char *op, int err) {
+	fprintf(stderr, "exec: %s: %s\n", op, strerror(err));
+	_exit(126);
+}
+
+#define GO_EXEC_MAX_NS 64
+
+// go_exec_forward is the pid that go_exec_forward_signal forwards signals to.
+static pid_t go_exec_forward;
+
+static void go_exec_forward_signal(int sig) {
+	kill(go_exec_forward, sig);
+}
+
+// go_exec_wait waits for the child pid, forwarding signals to it, and exits like it.
+static void go_exec_wait(pid_t pid) {
+	go_exec_forward = pid;
+	struct sigaction sa;
+	memset(&sa, 0, sizeof sa);
+	sa.sa_handler = go_exec_forward_signal;
+	sa.sa_flags = SA_RESTART;
+	for (int sig = 1; sig < NSIG; sig++) {
+		if (sig != SIGKILL && sig != SIGSTOP && sig != SIGCHLD && sig != SIGURG) {
+			sigaction(sig, &sa, NULL);
+		}
+	}
+	int status;
+	while (waitpid(pid, &status, 0) < 0) {
+		if (errno != EINTR) {
+			go_exec_fail("waitpid", errno);
+		}
+	}
+	if (WIFSIGNALED(status)) {
+		int sig = WTERMSIG(status);
+		signal(sig, SIG_DFL);
+		sigset_t set;
+		sigemptyset(&set);
+		sigaddset(&set, sig);
+		sigprocmask(SIG_UNBLOCK, &set, NULL);
+		kill(getpid(), sig);
+		_exit(128 + sig);
+	}
+	_exit(WEXITSTATUS(status));
+}
+
+#ifndef NS_GET_NSTYPE
+#define NS_GET_NSTYPE _IO(0xb7, 0x3)
+#endif
+#ifndef SYS_pidfd_send_signal
+#define SYS_pidfd_send_signal 424
+#endif
+
+// go_exec_check_ns fails unless fd is a namespace file of the type flags, or a
+// pidfd, so that the process doesn't join whatever else is open at fd.
+static void go_exec_check_ns(int fd, int flags) {
+	int type = ioctl(fd, NS_GET_NSTYPE);
+	if (type >= 0) {
+		if (type != flags) {
+			go_exec_fail("setns", EINVAL);
+		}
+		return;
+	}
+	if (syscall(SYS_pidfd_send_signal, fd, 0, NULL, 0) != 0 && errno == EBADF) {
+		go_exec_fail("setns", EBADF);
+	}
+}
+
+// go_exec_setns enters the namespaces that GO_EXEC_SETNS lists as "fd:flags" pairs,
+// while the process is still single threaded, and closes their files. See
+// setns_linux.go in package exec.
+static void go_exec_setns(void) {
+	const char *env = secure_getenv("GO_EXEC_SETNS");
+	if (env == NULL) {
+		return;
+	}
+	int fds[GO_EXEC_MAX_NS];
+	int flags[GO_EXEC_MAX_NS];
+	int n = 0;
+	int all = 0;
+	for (const char *p = env; *p != '\0'; n++) {
+		if (n == GO_EXEC_MAX_NS) {
+			go_exec_fail("setns", E2BIG);
+		}
+		char *end;
+		fds[n] = (int)strtol(p, &end, 10);
+		if (*end != ':') {
+			go_exec_fail("setns", EINVAL);
+		}
+		flags[n] = (int)strtol(end + 1, &end, 10);
+		if (*end != ',' && *end != '\0') {
+			go_exec_fail("setns", EINVAL);
+		}
+		go_exec_check_ns(fds[n], flags[n]);
+		all |= flags[n];
+		p = *end == ',' ? end + 1 : end;
+	}
+
+	// Like nsenter(1), first enter every namespace but the user namespaces, which
+	// succeeds if the process is privileged in them. Whatever fails is entered after
+	// the user namespaces, which grant the privileges that an unprivileged process
+	// lacks.
+	for (int i = 0; i < n; i++) {
+		int f = flags[i] & ~CLONE_NEWUSER;
+		if (f != 0 && setns(fds[i], f) == 0) {
+			flags[i] &= CLONE_NEWUSER;
+		}
+	}
+	for (int i = 0; i < n; i++) {
+		if ((flags[i] & CLONE_NEWUSER) != 0) {
+			if (setns(fds[i], CLONE_NEWUSER) != 0) {
+				go_exec_fail("setns", errno);
+			}
+			flags[i] &= ~CLONE_NEWUSER;
+		}
+	}
+	for (int i = 0; i < n; i++) {
+		if (flags[i] != 0 && setns(fds[i], flags[i]) != 0) {
+			go_exec_fail("setns", errno);
+		}
+		close(fds[i]);
+	}
+
+	// Only the children of the process enter the PID namespace.
+	if ((all & CLONE_NEWPID) != 0) {
+		pid_t pid = fork();
+		if (pid < 0) {
+			go_exec_fail("fork", errno);
+		}
+		if (pid > 0) {
+			go_exec_wait(pid);
+		}
+	}
+}
+
+// go_exec_userns unshares the user namespace of the process, which is still single
+// threaded, if GO_EXEC_USERNS is set. See userns_linux.go in package exec.
+static void go_exec_userns(void) {
+	if (secure_getenv("GO_EXEC_USERNS") == NULL) {
+		return;
+	}
+	const char *uid_map = secure_getenv("GO_EXEC_USERNS_UID_MAP");
+	const char *gid_map = secure_getenv("GO_EXEC_USERNS_GID_MAP");
+	const char *setgroups = secure_getenv("GO_EXEC_USERNS_SETGROUPS");
+
+	// The helper waits for the process to unshare its user namespace and then maps
+	// the IDs of the new one from the old one.
+	int sync[2];
+	if (pipe2(sync, O_CLOEXEC) != 0) {
+		go_exec_fail("pipe2", errno);
+	}
+	pid_t pid = getpid();
+	pid_t helper = fork();
+	if (helper < 0) {
+		go_exec_fail("fork", errno);
+	}
+	if (helper == 0) {
+		char ok = 0;
+		close(sync[1]);
+		if (read(sync[0], &ok, 1) != 1 || !ok) {
+			_exit(0);
+		}
+		int err;
+		if (setgroups != NULL && (err = go_exec_write_proc(pid, "setgroups", setgroups)) != 0) {
+			go_exec_fail("setgroups", err);
+		}
+		if (gid_map != NULL && (err = go_exec_write_proc(pid, "gid_map", gid_map)) != 0) {
+			go_exec_fail("gid_map", err);
+		}
+		if (uid_map != NULL && (err = go_exec_write_proc(pid, "uid_map", uid_map)) != 0) {
+			go_exec_fail("uid_map", err);
+		}
+		_exit(0);
+	}
+
+	close(sync[0]);
+	int err = unshare(CLONE_NEWUSER) != 0 ? errno : 0;
+	char ok = err == 0;
+	ssize_t n = write(sync[1], &ok, 1);
+	(void)n;
+	close(sync[1]);
+	int status;
+	while (waitpid(helper, &status, 0) < 0) {
+		if (errno != EINTR) {
+			go_exec_fail("waitpid", errno);
+		}
+	}
+	if (err != 0) {
+		go_exec_fail("unshare", err);
+	}
+	if (!WIFEXITED(status) || WEXITSTATUS(status) != 0) {
+		_exit(126);
+	}
+}
+
+#ifndef CLONE_NEWTIME
+#define CLONE_NEWTIME 0x80
+#endif
+
+// go_exec_timens unshares the time namespace of the process and sets the offsets
+// that GO_EXEC_TIMENS_OFFSETS holds, which only the main thread can do. See
+// timens_linux.go in package exec.
+static void go_exec_timens(void) {
+	const char *offsets = secure_getenv("GO_EXEC_TIMENS_OFFSETS");
+	if (offsets == NULL) {
+		return;
+	}
+	if (unshare(CLONE_NEWTIME) != 0) {
+		go_exec_fail("unshare", errno);
+	}
+	int err = go_exec_write_proc(getpid(), "timens_offsets", offsets);
+	if (err != 0) {
+		go_exec_fail("timens_offsets", err);
+	}
+}
+
+// go_exec_entrypoints are the entrypoints of package exec that the constructor runs
+// for, which are the only ones that the environment variables above are meant for.
+// See reexec_linux.go in package exec.
+static const char *go_exec_entrypoints[] = {
+	"github.com/jcbhmr/go-exec.execRest",
+	"github.com/jcbhmr/go-exec.check",
+};
+
+__attribute__((constructor)) static void go_exec_init(void) {
+	// secure_getenv ignores the environment in secure-execution mode, where it
+	// comes from a less privileged caller.
+	const char *entrypoint = secure_getenv("GO_EXEC_ENTRYPOINT");
+	if (entrypoint == NULL) {
+		return;
+	}
+	int found = 0;
+	for (size_t i = 0; i < sizeof go_exec_entrypoints / sizeof go_exec_entrypoints[0]; i++) {
+		found |= strcmp(entrypoint, go_exec_entrypoints[i]) == 0;
+	}
+	if (!found) {
+		return;
+	}
+	go_exec_setns();
+	go_exec_userns();
+	go_exec_timens();
+}
+*/
+import "C"
+
+import "github.com/jcbhmr/go-exec/internal/constructor"
+
+func init() {
+	constructor.Linked = true
+}
@@ -0,0 +1,17 @@
+// Package nsenter links in the cgo constructor that package exec needs on Linux to
+// create a new user namespace, to set the offsets of a new time namespace, and to
+// enter an existing mount, PID, time or user namespace. The kernel only lets a
+// single-threaded process do those, and a Go program never is one once the runtime
+// has started, so Exec re-executes the current executable and the constructor does
+// them first.
+//
+// A program that needs them imports the package for its side effect, and is built
+// with cgo:
+//
+//	import _ "github.com/jcbhmr/go-exec/nsenter"
+//
+// The constructor does nothing unless the current process is a copy of the current
+// executable that Exec started for that purpose, and ignores the environment in
+// secure-execution mode. Without cgo, or on other platforms, the package does
+// nothing.
+package nsenter
@@ -0,0 +1,159 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The entrypoints of the processes that [ExecOptions.PidInit] adds. The current
+// process is replaced by the pidProxy entrypoint, which clones the pidInit entrypoint
+// into a new PID namespace, which in turn starts the execRest entrypoint to carry out
+// the rest of the Exec.
+const (
+	pidProxyEntrypoint = "github.com/jcbhmr/go-exec.pidProxy"
+	pidInitEntrypoint  = "github.com/jcbhmr/go-exec.pidInit"
+)
+
+var (
+	_ = registerEntrypoint(pidProxyEntrypoint, runPidProxy)
+	_ = registerEntrypoint(pidInitEntrypoint, runPidInit)
+)
+
+// pidInitRequest is the payload of the pidProxy and pidInit entrypoints.
+type pidInitRequest struct {
+	Exec execRequest
+	// Proc is where the init mounts /proc, if anywhere.
+	Proc string
+}
+
+// execPidInit carries out the rest of an Exec, which execProcessThread has done up to
+// unshare(2) except for CLONE_NEWPID, in a child of the init of a new PID namespace.
+func execPidInit(s *execState, argv0 string, argv []string, attr *syscall.ProcAttr, sys *unix.SysProcAttr, unshareflags uintptr) error {
+	rest := *sys
+	rest.Unshareflags = 0
+	rest.Cloneflags = 0
+	rest.UseCgroupFD = false
+	rest.Setsid = false
+	rest.Setpgid = false
+	rest.Foreground = false
+	if len(s.opts.Mounts) > 0 || s.opts.PivotRoot != "" {
+		// The rest sets up its mounts in a mount namespace of its own, below the one
+		// that the init mounts /proc in.
+		rest.Unshareflags = unix.CLONE_NEWNS
+	}
+	req := pidInitRequest{Exec: newExecRequest(s, argv0, argv, attr, &rest)}
+	// The new network and UTS namespaces are already set up.
+	req.Exec.LoopbackUp, req.Exec.Hostname, req.Exec.Domainname = false, "", ""
+	if unshareflags&unix.CLONE_NEWNS != 0 && s.opts.PivotRoot == "" {
+		// The /proc of a new root directory is up to Mounts, which run in the PID
+		// namespace too.
+		req.Proc = "/proc"
+		if sys.Chroot != "" {
+			req.Proc = filepath.Join(sys.Chroot, "proc")
+		}
+	}
+	err := reexec(s, pidProxyEntrypoint, req, attr)
+	if err != nil || !s.dryRun {
+		return err
+	}
+	// The pidProxy entrypoint clones the pidInit entrypoint, which starts the
+	// execRest entrypoint.
+	steps := []ExecStep{{Op: "clone", Call: "clone(CLONE_NEWPID)"}}
+	if req.Proc != "" {
+		steps = append(steps, ExecStep{Op: "mount", Call: mountCall("proc", req.Proc, "proc", procMountFlags, "")})
+	}
+	steps = append(steps,
+		ExecStep{Op: "clone", Call: "clone()"},
+		ExecStep{Op: "execve", Call: fmt.Sprintf("execve(%q, %q)", "/proc/self/exe", []string{execRestEntrypoint})},
+	)
+	return req.Exec.plan(s, steps...)
+}
+
+// procMountFlags are the flags that the init mounts /proc with.
+const procMountFlags = unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC
+
+// runPidProxy is the main function of the pidProxy entrypoint.
+func runPidProxy() {
+	var req pidInitRequest
+	err := EntrypointPayload(&req)
+	if err == nil {
+		var cmd *exec.Cmd
+		cmd, err = req.Exec.command(pidInitEntrypoint, req)
+		if err == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWPID}
+			err = (*CmdExt)(cmd).EmulateExec()
+		}
+	}
+	fmt.Fprintln(os.Stderr, "exec:", err)
+	os.Exit(126)
+}
+
+// runPidInit is the main function of the pidInit entrypoint.
+func runPidInit() {
+	var req pidInitRequest
+	err := EntrypointPayload(&req)
+	if err == nil && req.Proc != "" {
+		err = unix.Mount("proc", req.Proc, "proc", procMountFlags, "")
+		if err != nil {
+			err = &os.PathError{Op: "mount", Path: req.Proc, Err: err}
+		}
+	}
+	if err == nil {
+		var status int
+		status, err = pidInit(&req.Exec)
+		if err == nil {
+			os.Exit(status)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "exec:", err)
+	os.Exit(126)
+}
+
+// pidInit carries out req in a child of the current process, which is the first
+// process of its PID namespace, and returns its exit status, or 128 plus the number
+// of the signal that killed it, once it exits. Meanwhile, it forwards signals to the
+// child and reaps the other processes that exit.
+func pidInit(req *execRequest) (int, error) {
+	cmd, err := req.command(execRestEntrypoint, req)
+	if err != nil {
+		return 0, err
+	}
+	takeForeground(cmd)
+
+	signals := make(chan os.Signal, 64)
+	signal.Notify(signals)
+	err = cmd.Start()
+	for _, f := range cmd.ExtraFiles {
+		if f != nil {
+			_ = f.Close()
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	go forwardSignals(signals, cmd.Process)
+
+	for {
+		var status unix.WaitStatus
+		pid, err := unix.Wait4(-1, &status, 0, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if pid != cmd.Process.Pid {
+			continue
+		}
+		if status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return status.ExitStatus(), nil
+	}
+}
@@ -0,0 +1,100 @@
+//go:build unix || plan9
+
+package exec
+
+import (
+	"os"
+	"strings"
+)
+
+// ExecPlan describes what [ExecProcess] or [CmdExt.Exec] would do, without doing it.
+//
+// An ExecPlan can be printed with [ExecPlan.String] or marshaled as JSON.
+type ExecPlan struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	Env  []string `json:"env"`
+	Dir  string   `json:"dir,omitempty"`
+
+	// Files holds, for each file descriptor of the new process, the file descriptor
+	// of the current process that it is a copy of, or -1 if it is closed.
+	Files []int `json:"files"`
+
+	// LeakedFds holds the file descriptors of the current process that the new
+	// process would inherit although they aren't in Files, because they don't have
+	// the close-on-exec flag set. See [ExecOptions.CloseOtherFds].
+	LeakedFds []int `json:"leakedFds,omitempty"`
+
+	// Steps are the system calls that lead up to and include execve(2), in order.
+	// When Exec has to re-execute the current executable on Linux, to enter a new
+	// user or time namespace, an existing namespace that a thread can't enter on
+	// its own, or a new PID namespace with PidInit, Steps go on after its
+	// execve("/proc/self/exe") with the steps that the re-executed executable takes,
+	// up to the execve(2) of the new program.
+	Steps []ExecStep `json:"steps"`
+}
+
+// ExecStep is a single step of an [ExecPlan].
+type ExecStep struct {
+	// Op names the step. It is the same as [ExecError.Op] would be if the step
+	// failed, or "stdin" for copying a Stdin reader into an anonymous file or relaying
+	// it through a pipe, which [CmdExt.Plan] plans without reading from it. The steps
+	// of a re-executed current executable have no ExecError, since the Exec has
+	// succeeded by then. They are named like the error message that it exits with
+	// would name them, which adds "fork", "clone", "uid_map", "gid_map" and
+	// "timens_offsets".
+	Op string `json:"op"`
+	// Call is a human-readable rendering of the system call, like "dup3(4, 0, 0)".
+	Call string `json:"call"`
+}
+
+func (s ExecStep) String() string {
+	return s.Call
+}
+
+// String returns the calls of p.Steps, one per line.
+func (p *ExecPlan) String() string {
+	var b strings.Builder
+	for _, s := range p.Steps {
+		b.WriteString(s.Call)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// PlanProcess is like [ExecProcess], but instead of replacing the current process it
+// returns the [ExecPlan] that ExecProcess would carry out.
+func PlanProcess(name string, argv []string, attr *os.ProcAttr) (*ExecPlan, error) {
+	return PlanProcessWith(name, argv, attr, nil)
+}
+
+// PlanProcessWith is like [PlanProcess] but takes the same additional options as
+// [ExecProcessWith].
+func PlanProcessWith(name string, argv []string, attr *os.ProcAttr, opts *ExecOptions) (*ExecPlan, error) {
+	s := newExecState(name, argv, opts)
+	s.dryRun = true
+	err := execProcessAttr(s, name, argv, attr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ExecPlan{
+		Path:  name,
+		Args:  argv,
+		Steps: s.steps,
+	}
+	sysattr, err := s.lower(attr)
+	if err != nil {
+		return nil, err
+	}
+	if sysattr != nil {
+		p.Env = sysattr.Env
+		p.Dir = sysattr.Dir
+		p.Files = make([]int, len(sysattr.Files))
+		for i, f := range sysattr.Files {
+			p.Files[i] = int(f)
+		}
+	}
+	p.LeakedFds = leakedFds(len(p.Files), s.opts)
+	return p, nil
+}
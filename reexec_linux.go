@@ -0,0 +1,240 @@
+package exec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// execRestEntrypoint is the entrypoint that carries out the rest of an Exec, which
+// the process that started it couldn't do itself. See [execRequest].
+const execRestEntrypoint = "github.com/jcbhmr/go-exec.execRest"
+
+var _ = registerEntrypoint(execRestEntrypoint, runExecRest)
+
+// checkEntrypoint is the entrypoint that the preflight checks of Exec start to
+// find out whether the constructor in package nsenter succeeds. It does nothing.
+const checkEntrypoint = "github.com/jcbhmr/go-exec.check"
+
+var _ = registerEntrypoint(checkEntrypoint, func() {})
+
+// needsConstructor completes the errors for what Exec can't do without the
+// constructor in package nsenter.
+const needsConstructor = "a program that imports github.com/jcbhmr/go-exec/nsenter and is built with cgo"
+
+func init() {
+	execPreflight = preflight
+}
+
+// preflight checks that the re-executed current executable will be able to enter
+// the namespaces that s and attr ask for, in the order that it would.
+func preflight(s *execState, attr *syscall.ProcAttr) error {
+	err := checkSetns(s)
+	if err != nil {
+		return err
+	}
+	err = checkUserns(s, attr)
+	if err != nil {
+		return err
+	}
+	return checkTimens(s, attr)
+}
+
+// runCheck runs cmd, which starts checkEntrypoint, and returns the error that the
+// constructor printed if it fails, without the prefix for op.
+func runCheck(cmd *exec.Cmd, op string) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+		return errors.New(strings.TrimPrefix(strings.TrimPrefix(msg, "exec: "), op+": "))
+	}
+	return err
+}
+
+// unsetEnv unsets the environment variables keys, which the constructor in
+// package nsenter has used by the time that Go code runs, so that nothing passes
+// them on to a process of its own.
+func unsetEnv(keys ...string) struct{} {
+	for _, key := range keys {
+		_ = os.Unsetenv(key)
+	}
+	return struct{}{}
+}
+
+// execRequest is the payload of the execRest entrypoint. It holds the rest of an
+// Exec, whose files are already at their file descriptor numbers.
+type execRequest struct {
+	Path string
+	Argv []string
+	Env  []string
+	Dir  string
+	// Files reports, for each file descriptor of the new program, whether it is
+	// open.
+	Files         []bool
+	Sys           *unix.SysProcAttr
+	CloseOtherFds bool
+	PidInit       bool
+	Mounts        []Mount
+	PivotRoot     string
+	LoopbackUp    bool
+	Hostname      string
+	Domainname    string
+
+	MonotonicOffset time.Duration
+	BoottimeOffset  time.Duration
+}
+
+// newExecRequest returns the request for the rest of the Exec of argv0 with attr,
+// which has done the steps that sys no longer asks for.
+func newExecRequest(s *execState, argv0 string, argv []string, attr *syscall.ProcAttr, sys *unix.SysProcAttr) execRequest {
+	req := execRequest{
+		Path:          argv0,
+		Argv:          argv,
+		Env:           attr.Env,
+		Dir:           attr.Dir,
+		Files:         make([]bool, len(attr.Files)),
+		Sys:           sys,
+		CloseOtherFds: s.opts.CloseOtherFds,
+		PidInit:       s.opts.PidInit,
+		Mounts:        s.opts.Mounts,
+		PivotRoot:     s.opts.PivotRoot,
+		LoopbackUp:    s.opts.LoopbackUp,
+		Hostname:      s.opts.Hostname,
+		Domainname:    s.opts.Domainname,
+
+		MonotonicOffset: s.opts.MonotonicOffset,
+		BoottimeOffset:  s.opts.BoottimeOffset,
+	}
+	for i, fd := range attr.Files {
+		req.Files[i] = fd != ^uintptr(0)
+	}
+	return req
+}
+
+// reexec executes entrypoint in the current executable in place of the Exec of
+// attr, with the files of attr at the same file descriptor numbers and payload after
+// them. env is added to the environment of the current process.
+func reexec(s *execState, entrypoint string, payload any, attr *syscall.ProcAttr, env ...string) error {
+	f, err := payloadFile(payload)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	env = append(slices.Concat(os.Environ(), env),
+		entrypointEnv+"="+entrypoint,
+		entrypointPayloadEnv+"="+strconv.Itoa(len(attr.Files)),
+	)
+	self := &syscall.ProcAttr{
+		Env:   env,
+		Files: append(slices.Clone(attr.Files), f.Fd()),
+	}
+	// The entrypoint carries out the options that apply to the new program.
+	opts := s.opts
+	s.opts = &ExecOptions{CloseOtherFds: opts.CloseOtherFds}
+	defer func() { s.opts = opts }()
+	return execProcessThread(s, "/proc/self/exe", []string{entrypoint}, self, &zeroSysProcAttr)
+}
+
+// command returns a command that runs entrypoint in a copy of the current
+// executable, with the files of r at the same file descriptor numbers and payload
+// after them. The ExtraFiles of the command are only used by it, so the caller
+// closes them once it has started.
+func (r *execRequest) command(entrypoint string, payload any) (*exec.Cmd, error) {
+	f, err := payloadFile(payload)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &exec.Cmd{
+		Path: "/proc/self/exe",
+		Args: []string{entrypoint},
+		Env:  append(os.Environ(), entrypointEnv+"="+entrypoint, entrypointPayloadEnv+"="+strconv.Itoa(max(len(r.Files), 3))),
+	}
+	// The standard input, output and error of the current process are the ones of r.
+	// If they are closed, os/exec opens the null device for them instead.
+	if len(r.Files) > 0 && r.Files[0] {
+		cmd.Stdin = os.Stdin
+	}
+	if len(r.Files) > 1 && r.Files[1] {
+		cmd.Stdout = os.Stdout
+	}
+	if len(r.Files) > 2 && r.Files[2] {
+		cmd.Stderr = os.Stderr
+	}
+	for i := 3; i < len(r.Files); i++ {
+		var file *os.File
+		if r.Files[i] {
+			file = os.NewFile(uintptr(i), "fd"+strconv.Itoa(i))
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, file)
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	return cmd, nil
+}
+
+// runExecRest is the main function of the execRest entrypoint.
+func runExecRest() {
+	var req execRequest
+	err := EntrypointPayload(&req)
+	if err == nil {
+		err = req.exec()
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(126)
+}
+
+// exec carries out r in the current process, like execProcess.
+func (r *execRequest) exec() error {
+	s, attr := r.state()
+	return execProcess(s, r.Path, r.Argv, attr)
+}
+
+// plan records the steps of r for the dry run s, after trampoline, which are the
+// steps that the re-executed current executable takes before it carries out r.
+func (r *execRequest) plan(s *execState, trampoline ...ExecStep) error {
+	s.steps = append(s.steps, trampoline...)
+	rs, attr := r.state()
+	rs.dryRun = true
+	err := execProcess(rs, r.Path, r.Argv, attr)
+	s.steps = append(s.steps, rs.steps...)
+	return err
+}
+
+// state returns the state and the attributes of an execProcess that carries out r.
+func (r *execRequest) state() (*execState, *syscall.ProcAttr) {
+	attr := &syscall.ProcAttr{
+		Dir:   r.Dir,
+		Env:   r.Env,
+		Files: make([]uintptr, len(r.Files)),
+		Sys:   r.Sys,
+	}
+	for i, open := range r.Files {
+		attr.Files[i] = ^uintptr(0)
+		if open {
+			attr.Files[i] = uintptr(i)
+		}
+	}
+	s := newExecState(r.Path, r.Argv, &ExecOptions{
+		CloseOtherFds: r.CloseOtherFds,
+		PidInit:       r.PidInit,
+		Mounts:        r.Mounts,
+		PivotRoot:     r.PivotRoot,
+		LoopbackUp:    r.LoopbackUp,
+		Hostname:      r.Hostname,
+		Domainname:    r.Domainname,
+
+		MonotonicOffset: r.MonotonicOffset,
+		BoottimeOffset:  r.BoottimeOffset,
+	})
+	return s, attr
+}
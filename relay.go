@@ -0,0 +1,105 @@
+//go:build unix || plan9
+
+package exec
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// stdinRelayEntrypoint is the entrypoint that a stdin relay process runs. See
+// [stdioFiles.relay].
+const stdinRelayEntrypoint = "github.com/jcbhmr/go-exec.stdinRelay"
+
+var _ = registerEntrypoint(stdinRelayEntrypoint, func() { os.Exit(runStdinRelay()) })
+
+// The files of a stdin relay process besides its standard input, output and error.
+const (
+	relayPrefixFd = 3 // holds the bytes to write before copying standard input
+	relaySyncFd   = 4 // is read until EOF before copying anything
+)
+
+// runStdinRelay is the main function of a stdin relay process. It waits for the
+// process that started it to either exec, which closes the write end of the sync
+// pipe, or to write to the sync pipe because Exec failed. In the former case, it
+// copies the prefix and then its standard input to its standard output, which is
+// the standard input of the new program.
+func runStdinRelay() int {
+	sync := os.NewFile(relaySyncFd, "sync")
+	var b [1]byte
+	n, _ := sync.Read(b[:])
+	if n > 0 {
+		return 0
+	}
+
+	prefix := os.NewFile(relayPrefixFd, "prefix")
+	_, err := io.Copy(os.Stdout, prefix)
+	if err == nil {
+		_, err = io.Copy(os.Stdout, os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "exec: stdin relay:", err)
+		return 1
+	}
+	return 0
+}
+
+// relay returns the read end of a pipe that a new relay process writes prefix and
+// then the contents of f to once Exec succeeds. The relay runs stdinRelayEntrypoint,
+// which the init function of this package dispatches to before main runs.
+//
+// If Exec fails, Close stops the relay before it reads anything from f.
+func (s *stdioFiles) relay(prefix []byte, f *os.File) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	s.opened = append(s.opened, r)
+	defer w.Close()
+	if s.plan {
+		s.steps = append(s.steps, ExecStep{Op: "stdin", Call: fmt.Sprintf("relay stdin (%d buffered bytes)", len(prefix))})
+		return r, nil
+	}
+
+	prefixFile, err := memFile("stdin-prefix")
+	if err != nil {
+		return nil, err
+	}
+	defer prefixFile.Close()
+	_, err = prefixFile.Write(prefix)
+	if err == nil {
+		_, err = prefixFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer syncR.Close()
+
+	cmd, err := EntrypointCommand(stdinRelayEntrypoint, nil)
+	if err == nil {
+		cmd.Stdin = f
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		cmd.ExtraFiles = []*os.File{prefixFile, syncR}
+		err = (*exec.Cmd)(cmd).Start()
+	}
+	if err != nil {
+		_ = syncW.Close()
+		return nil, err
+	}
+
+	// syncW is close-on-exec, so the relay reads EOF from it as soon as Exec succeeds.
+	s.restore = append(s.restore, func() {
+		_, _ = syncW.Write([]byte{0})
+		_ = syncW.Close()
+		_ = (*exec.Cmd)(cmd).Wait()
+	})
+	return r, nil
+}
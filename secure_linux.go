@@ -0,0 +1,25 @@
+package exec
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// atSecure is the auxiliary vector entry AT_SECURE, which x/sys/unix doesn't define.
+const atSecure = 23
+
+// secureMode reports whether the current process runs in secure-execution mode,
+// like a set-user-ID program or one with file capabilities, whose environment comes
+// from a less privileged caller. See getauxval(3).
+func secureMode() bool {
+	auxv, err := unix.Auxv()
+	if err == nil {
+		for _, kv := range auxv {
+			if kv[0] == atSecure {
+				return kv[1] != 0
+			}
+		}
+	}
+	return os.Getuid() != os.Geteuid() || os.Getgid() != os.Getegid()
+}
@@ -0,0 +1,12 @@
+//go:build (unix && !linux) || plan9
+
+package exec
+
+import "os"
+
+// secureMode reports whether the current process runs with the privileges of a
+// set-user-ID or set-group-ID program, whose environment comes from a less
+// privileged caller.
+func secureMode() bool {
+	return os.Getuid() != os.Geteuid() || os.Getgid() != os.Getegid()
+}
@@ -0,0 +1,280 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/jcbhmr/go-exec/internal/constructor"
+	"golang.org/x/sys/unix"
+)
+
+// Only a single-threaded process can enter a mount, PID, time or user namespace
+// with setns(2). So for those, Exec re-executes the current executable with the
+// environment variable below, which holds "fd:flags" pairs separated by commas, and
+// the constructor in package nsenter enters the namespaces before the Go runtime
+// starts any threads. The execRest entrypoint then carries out the rest of the Exec.
+const setnsEnv = "GO_EXEC_SETNS"
+
+var _ = unsetEnv(setnsEnv)
+
+// threadNamespaceFlags are the types of namespaces that the calling thread can
+// enter on its own, and leave again.
+const threadNamespaceFlags = unix.CLONE_NEWNET | unix.CLONE_NEWUTS | unix.CLONE_NEWIPC | unix.CLONE_NEWCGROUP
+
+// namespaceTypes are the types of namespaces, with the names of their files in
+// /proc/<pid>/ns.
+var namespaceTypes = []struct {
+	flag uintptr
+	name string
+	file string
+}{
+	{unix.CLONE_NEWCGROUP, "CLONE_NEWCGROUP", "cgroup"},
+	{unix.CLONE_NEWIPC, "CLONE_NEWIPC", "ipc"},
+	{unix.CLONE_NEWNET, "CLONE_NEWNET", "net"},
+	{unix.CLONE_NEWNS, "CLONE_NEWNS", "mnt"},
+	{unix.CLONE_NEWPID, "CLONE_NEWPID", "pid"},
+	{unix.CLONE_NEWTIME, "CLONE_NEWTIME", "time"},
+	{unix.CLONE_NEWUSER, "CLONE_NEWUSER", "user"},
+	{unix.CLONE_NEWUTS, "CLONE_NEWUTS", "uts"},
+}
+
+// nsFile is an open namespace file or pidfd of a [Namespace].
+type nsFile struct {
+	file  *os.File
+	flags uintptr // the namespace types to enter
+	name  string  // the path or pidfd, for ExecSteps
+}
+
+// setnsCall renders the call to setns(2) that enters the namespaces of f for an
+// ExecStep.
+func (f *nsFile) setnsCall() string {
+	var names []string
+	for _, t := range namespaceTypes {
+		if f.flags&t.flag != 0 {
+			names = append(names, t.name)
+		}
+	}
+	return fmt.Sprintf("setns(%s, %s)", f.name, strings.Join(names, "|"))
+}
+
+// openNamespaces opens the namespace files of namespaces, and duplicates their
+// pidfds, so that they stay open until the namespaces are entered.
+func openNamespaces(namespaces []Namespace) ([]nsFile, error) {
+	var files []nsFile
+	for _, ns := range namespaces {
+		f, err := openNamespace(ns)
+		if err != nil {
+			closeNamespaces(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func openNamespace(ns Namespace) (nsFile, error) {
+	if ns.Type&^cloneNamespaceFlags != 0 {
+		return nsFile{}, fmt.Errorf("exec: Namespace Type %#x has flags other than CLONE_NEW*", ns.Type)
+	}
+	if ns.UsePidFD {
+		if ns.Type == 0 {
+			return nsFile{}, errors.New("exec: Namespace with UsePidFD needs a Type")
+		}
+		if ns.PidFD < 0 {
+			return nsFile{}, fmt.Errorf("exec: Namespace with UsePidFD has negative PidFD %d", ns.PidFD)
+		}
+		fd, err := unix.FcntlInt(uintptr(ns.PidFD), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			return nsFile{}, os.NewSyscallError("fcntl", err)
+		}
+		name := fmt.Sprintf("pidfd %d", ns.PidFD)
+		return nsFile{file: os.NewFile(uintptr(fd), name), flags: ns.Type, name: name}, nil
+	}
+	if ns.Type&(ns.Type-1) != 0 {
+		return nsFile{}, fmt.Errorf("exec: Namespace Type %#x for %s has more than one flag", ns.Type, ns.Path)
+	}
+	f, err := os.Open(ns.Path)
+	if err != nil {
+		return nsFile{}, err
+	}
+	flags := ns.Type
+	if flags == 0 {
+		t, err := unix.IoctlRetInt(int(f.Fd()), unix.NS_GET_NSTYPE)
+		if err != nil {
+			_ = f.Close()
+			return nsFile{}, &os.PathError{Op: "ioctl", Path: ns.Path, Err: err}
+		}
+		flags = uintptr(t)
+	}
+	return nsFile{file: f, flags: flags, name: fmt.Sprintf("%q", ns.Path)}, nil
+}
+
+func closeNamespaces(files []nsFile) {
+	for _, f := range files {
+		_ = f.file.Close()
+	}
+}
+
+// threadNamespaces reports whether the calling thread can enter the namespaces of
+// files on its own.
+func threadNamespaces(files []nsFile) bool {
+	for _, f := range files {
+		if f.flags&^threadNamespaceFlags != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// enterNamespaces enters the namespaces of files with the calling thread, which
+// threadNamespaces allows.
+func enterNamespaces(s *execState, files []nsFile) error {
+	for _, f := range files {
+		err := s.doReversible("setns", f.setnsCall(), func() (func(), error) {
+			restore, err := saveNamespaces(f.flags)
+			if err != nil {
+				return nil, err
+			}
+			err = unix.Setns(int(f.file.Fd()), int(f.flags))
+			if err != nil {
+				restore()
+				return nil, err
+			}
+			return restore, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveNamespaces returns a function that returns the calling thread to its current
+// namespaces of the types in flags.
+func saveNamespaces(flags uintptr) (restore func(), err error) {
+	var fds []int
+	restore = func() {
+		for _, fd := range fds {
+			_ = unix.Setns(fd, 0)
+			_ = unix.Close(fd)
+		}
+	}
+	for _, t := range namespaceTypes {
+		if flags&t.flag == 0 {
+			continue
+		}
+		fd, err := unix.Open("/proc/thread-self/ns/"+t.file, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			for _, fd := range fds {
+				_ = unix.Close(fd)
+			}
+			return nil, err
+		}
+		fds = append(fds, fd)
+	}
+	return restore, nil
+}
+
+// setnsEnvValue returns the value of setnsEnv for files at consecutive file
+// descriptor numbers, starting at fd.
+func setnsEnvValue(files []nsFile, fd int) string {
+	pairs := make([]string, len(files))
+	for i, f := range files {
+		pairs[i] = fmt.Sprintf("%d:%d", fd+i, f.flags)
+	}
+	return setnsEnv + "=" + strings.Join(pairs, ",")
+}
+
+// checkSetns starts the current executable in the namespaces of s.opts.Namespaces,
+// if the calling thread can't enter them on its own, so that Exec can fail while it
+// can still roll back if they can't be entered.
+func checkSetns(s *execState) error {
+	if len(s.opts.Namespaces) == 0 {
+		return nil
+	}
+	files, err := openNamespaces(s.opts.Namespaces)
+	if err != nil {
+		return err
+	}
+	defer closeNamespaces(files)
+	if threadNamespaces(files) {
+		return nil
+	}
+	calls := make([]string, len(files))
+	for i, f := range files {
+		calls[i] = f.setnsCall()
+	}
+	return s.doReversible("setns", strings.Join(calls, "; "), func() (func(), error) {
+		if !constructor.Linked {
+			return nil, errors.New("entering a mount, PID, time or user namespace needs " + needsConstructor)
+		}
+		cmd, err := EntrypointCommand(checkEntrypoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, setnsEnvValue(files, 3))
+		for _, f := range files {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, f.file)
+		}
+		err = runCheck((*exec.Cmd)(cmd), "setns")
+		if err != nil {
+			return nil, err
+		}
+		return func() {}, nil
+	})
+}
+
+// execSetns carries out the rest of an Exec, which execProcessThread has done up to
+// entering the namespaces of files, by executing the current executable so that it
+// enters them, and the execRest entrypoint in them.
+func execSetns(s *execState, argv0 string, argv []string, attr *syscall.ProcAttr, sys *unix.SysProcAttr, unshareflags uintptr, files []nsFile) error {
+	rest := *sys
+	rest.Unshareflags = unshareflags
+	rest.Cloneflags = 0
+	rest.UseCgroupFD = false
+	rest.Setsid = false
+	rest.Setpgid = false
+	rest.Foreground = false
+
+	// The namespace files follow the files of attr, and the constructor closes them.
+	self := *attr
+	self.Files = slices.Clone(attr.Files)
+	for _, f := range files {
+		self.Files = append(self.Files, f.file.Fd())
+	}
+	req := newExecRequest(s, argv0, argv, attr, &rest)
+	err := reexec(s, execRestEntrypoint, req, &self, setnsEnvValue(files, len(attr.Files)))
+	if err != nil || !s.dryRun {
+		return err
+	}
+	return req.plan(s, setnsSteps(files)...)
+}
+
+// setnsSteps returns the steps that the constructor takes to enter the namespaces
+// of files, if it succeeds without retrying.
+func setnsSteps(files []nsFile) []ExecStep {
+	var steps []ExecStep
+	var all uintptr
+	for _, f := range files {
+		all |= f.flags
+		if f.flags&^unix.CLONE_NEWUSER != 0 {
+			f.flags &^= unix.CLONE_NEWUSER
+			steps = append(steps, ExecStep{Op: "setns", Call: f.setnsCall()})
+		}
+	}
+	for _, f := range files {
+		if f.flags&unix.CLONE_NEWUSER != 0 {
+			f.flags = unix.CLONE_NEWUSER
+			steps = append(steps, ExecStep{Op: "setns", Call: f.setnsCall()})
+		}
+	}
+	if all&unix.CLONE_NEWPID != 0 {
+		steps = append(steps, ExecStep{Op: "fork", Call: "fork()"})
+	}
+	return steps
+}
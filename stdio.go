@@ -0,0 +1,308 @@
+//go:build unix || plan9
+
+package exec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A FileUnwrapper returns the file descriptor underlying v, or ok == false if it
+// doesn't know how to find one. The descriptor only needs to stay valid until the
+// FileUnwrapper returns; Exec duplicates it.
+type FileUnwrapper func(v any) (fd uintptr, ok bool)
+
+var fileUnwrappers struct {
+	sync.RWMutex
+	list []FileUnwrapper
+}
+
+// RegisterFileUnwrapper makes [CmdExt.Exec] use unwrap to find the file descriptor
+// underlying a Stdin, Stdout or Stderr that is not an [*os.File]. Unwrappers are
+// tried most recently registered first, before the methods that Exec recognizes on
+// its own:
+//
+//   - SyscallConn, as in [syscall.Conn], implemented by [*net.TCPConn] and others
+//   - File() (*os.File, error), as in [*net.TCPConn.File]
+//   - Fd() uintptr, as in [*os.File.Fd]
+//
+// RegisterFileUnwrapper is safe to call concurrently, but is usually called from an
+// init function.
+func RegisterFileUnwrapper(unwrap FileUnwrapper) {
+	fileUnwrappers.Lock()
+	defer fileUnwrappers.Unlock()
+	fileUnwrappers.list = append(fileUnwrappers.list, unwrap)
+}
+
+// stdioFiles turns the Stdin, Stdout and Stderr of a [CmdExt] into [*os.File]
+// instances for the new process, and keeps track of the files that it opens along
+// the way so that they can be closed if Exec fails. If plan is set, it only goes as
+// far as [CmdExt.Plan] needs, and records what it would do with a Stdin reader in
+// steps rather than reading from it.
+type stdioFiles struct {
+	opts    *ExecOptions
+	plan    bool
+	opened  []*os.File
+	restore []func()
+	steps   []ExecStep
+}
+
+// file returns the file to use for the stream name, whose value in the [os/exec.Cmd]
+// is v. std is the corresponding stream of the current process and flag the mode in
+// which the null device is opened for it.
+func (s *stdioFiles) file(name string, v any, std *os.File, flag int) (*os.File, error) {
+	if v == nil {
+		if s.opts == nil || !s.opts.NullStdio {
+			return std, nil
+		}
+		f, err := os.OpenFile(os.DevNull, flag, 0)
+		if err != nil {
+			return nil, err
+		}
+		s.opened = append(s.opened, f)
+		return f, nil
+	}
+
+	f, err := s.fdFile(v)
+	if err == nil && f == nil && flag == os.O_RDONLY {
+		f, err = s.prefixed(v)
+	}
+	if r, ok := v.(io.Reader); ok && err == nil && f == nil && flag == os.O_RDONLY {
+		f, err = s.buffer(name, r)
+	}
+	if err != nil {
+		return nil, errors.New("exec: " + name + ": " + err.Error())
+	}
+	if f == nil {
+		return nil, errors.New("exec: " + name + " is not an *os.File and has no file descriptor")
+	}
+	return f, nil
+}
+
+// fdFile returns v if it is an [*os.File], the result of unwrap otherwise.
+func (s *stdioFiles) fdFile(v any) (*os.File, error) {
+	if f, ok := v.(*os.File); ok {
+		return f, nil
+	}
+	f, err := s.unwrap(v)
+	if f != nil {
+		s.opened = append(s.opened, f)
+	}
+	return f, err
+}
+
+// prefixed returns the read end of a pipe that a relay process fills with what is
+// left to read from v, if v reads some buffered bytes before the rest of a file. It
+// returns nil otherwise. See [splitPrefix].
+func (s *stdioFiles) prefixed(v any) (*os.File, error) {
+	prefix, rest, ok := splitPrefix(v)
+	if !ok {
+		return nil, nil
+	}
+	f, err := s.fdFile(rest)
+	if f == nil || err != nil {
+		return nil, err
+	}
+	if len(prefix) == 0 {
+		return f, nil
+	}
+	return s.relay(prefix, f)
+}
+
+// unwrap returns a new file that refers to the file descriptor underlying v, or nil
+// if it can't find one.
+func (s *stdioFiles) unwrap(v any) (*os.File, error) {
+	fileUnwrappers.RLock()
+	list := slices.Clone(fileUnwrappers.list)
+	fileUnwrappers.RUnlock()
+
+	for _, unwrap := range slices.Backward(list) {
+		fd, ok := unwrap(v)
+		if ok {
+			f, err := s.dup(fd)
+			runtime.KeepAlive(v)
+			return f, err
+		}
+	}
+
+	switch v := v.(type) {
+	case syscall.Conn:
+		rc, err := v.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		var f *os.File
+		err2 := rc.Control(func(fd uintptr) {
+			f, err = s.dup(fd)
+		})
+		if err2 != nil {
+			return nil, err2
+		}
+		return f, err
+	case interface{ File() (*os.File, error) }:
+		return v.File()
+	case interface{ Fd() uintptr }:
+		f, err := s.dup(v.Fd())
+		runtime.KeepAlive(v)
+		return f, err
+	}
+	return nil, nil
+}
+
+// buffer returns a new file, rewound and sealed, that holds what is left to read
+// from r. It returns nil if r has an unknown size and [ExecOptions.MaxStdinBuffer]
+// doesn't allow buffering it.
+func (s *stdioFiles) buffer(name string, r io.Reader) (*os.File, error) {
+	var data []byte
+	var limit int64
+	unknown := false
+	switch r := r.(type) {
+	case interface{ Bytes() []byte }:
+		data = r.Bytes()
+	case interface{ Len() int }:
+		limit = int64(r.Len())
+	default:
+		if s.opts == nil || s.opts.MaxStdinBuffer <= 0 {
+			return nil, nil
+		}
+		// Read one more byte than allowed to tell whether there is more.
+		limit = s.opts.MaxStdinBuffer + 1
+		unknown = true
+	}
+
+	f, err := memFile(strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	s.opened = append(s.opened, f)
+
+	if s.plan {
+		size := fmt.Sprintf("%d bytes", limit)
+		switch {
+		case data != nil:
+			size = fmt.Sprintf("%d bytes", len(data))
+		case unknown:
+			size = fmt.Sprintf("≤%d bytes", s.opts.MaxStdinBuffer)
+		}
+		s.steps = append(s.steps, ExecStep{Op: "stdin", Call: "buffer " + strings.ToLower(name) + " (" + size + ")"})
+		return f, nil
+	}
+
+	if data != nil {
+		_, err = f.Write(data)
+	} else {
+		if seeker, ok := r.(io.Seeker); ok {
+			offset, err := seeker.Seek(0, io.SeekCurrent)
+			if err == nil {
+				s.restore = append(s.restore, func() {
+					_, _ = seeker.Seek(offset, io.SeekStart)
+				})
+			}
+		}
+		var n int64
+		n, err = io.Copy(f, io.LimitReader(r, limit))
+		if err == nil && unknown && n == limit {
+			err = errors.New("more than MaxStdinBuffer bytes to read")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = sealFile(f)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// dup returns a new file that refers to a duplicate of fd.
+func (s *stdioFiles) dup(fd uintptr) (*os.File, error) {
+	f, restore, err := dupFile(fd)
+	if err != nil {
+		return nil, err
+	}
+	if restore != nil {
+		s.restore = append(s.restore, restore)
+	}
+	return f, nil
+}
+
+// Close undoes the changes that s made to the values it turned into files, such as
+// relays it started, and closes the files that it opened.
+func (s *stdioFiles) Close() {
+	for _, restore := range s.restore {
+		restore()
+	}
+	s.restore = nil
+	for _, f := range s.opened {
+		_ = f.Close()
+	}
+	s.opened = nil
+}
+
+var (
+	multiReaderType = reflect.TypeOf(io.MultiReader())
+	bufioReaderType = reflect.TypeFor[*bufio.Reader]()
+)
+
+// splitPrefix splits v into the bytes that it has buffered and the reader that it
+// reads from after that, if v is one of:
+//
+//   - a [*bufio.Reader]
+//   - an [io.MultiReader] whose readers other than the last are a [*bytes.Buffer] or
+//     a [*bytes.Reader] or [*strings.Reader]
+//
+// splitPrefix doesn't change what is left to read from v.
+func splitPrefix(v any) (prefix []byte, rest any, ok bool) {
+	switch reflect.TypeOf(v) {
+	case bufioReaderType:
+		br := reflect.ValueOf(v).Elem()
+		buf := *(*[]byte)(br.FieldByName("buf").Addr().UnsafePointer())
+		r := *(*int)(br.FieldByName("r").Addr().UnsafePointer())
+		w := *(*int)(br.FieldByName("w").Addr().UnsafePointer())
+		rd := *(*io.Reader)(br.FieldByName("rd").Addr().UnsafePointer())
+		return slices.Clone(buf[r:w]), rd, true
+	case multiReaderType:
+		mr := reflect.ValueOf(v).Elem()
+		readers := *(*[]io.Reader)(mr.FieldByName("readers").Addr().UnsafePointer())
+		if len(readers) == 0 {
+			return nil, nil, false
+		}
+		for _, r := range readers[:len(readers)-1] {
+			switch r := r.(type) {
+			case interface{ Bytes() []byte }:
+				prefix = append(prefix, r.Bytes()...)
+			case interface {
+				Len() int
+				io.ReadSeeker
+			}:
+				n := r.Len()
+				b := make([]byte, n)
+				_, err := io.ReadFull(r, b)
+				_, err2 := r.Seek(int64(-n), io.SeekCurrent)
+				if err != nil || err2 != nil {
+					return nil, nil, false
+				}
+				prefix = append(prefix, b...)
+			default:
+				return nil, nil, false
+			}
+		}
+		return prefix, readers[len(readers)-1], true
+	}
+	return nil, nil, false
+}
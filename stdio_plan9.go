@@ -0,0 +1,22 @@
+//go:build plan9
+
+package exec
+
+import (
+	"os"
+
+	"golang.org/x/sys/plan9"
+)
+
+// dupFile returns a new file that refers to a duplicate of fd.
+func dupFile(fd uintptr) (f *os.File, restore func(), err error) {
+	newfd, err := plan9.Dup(int(fd), -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(newfd), "dup"), nil, nil
+}
+
+// extraFiles does nothing, since Plan 9 has no non-blocking file descriptors for
+// [os.File.Fd] to change.
+func (s *stdioFiles) extraFiles(files []*os.File) {}
@@ -0,0 +1,79 @@
+//go:build unix
+
+package exec
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"weak"
+
+	"golang.org/x/sys/unix"
+)
+
+// dupFile returns a new file that refers to a close-on-exec duplicate of fd.
+//
+// The duplicate shares the file status flags of fd, and [os.File.Fd] puts it into
+// blocking mode for the new program. If fd was non-blocking, dupFile also returns a
+// function that makes it non-blocking again in case Exec fails. That function must
+// be called before the file is closed.
+func dupFile(fd uintptr) (f *os.File, restore func(), err error) {
+	flags, err := unix.FcntlInt(fd, unix.F_GETFL, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	syscall.ForkLock.RLock()
+	newfd, err := syscall.Dup(int(fd))
+	if err == nil {
+		syscall.CloseOnExec(newfd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if flags&unix.O_NONBLOCK != 0 {
+		restore = func() {
+			_ = unix.SetNonblock(newfd, true)
+		}
+	}
+	return os.NewFile(uintptr(newfd), "dup"), restore, nil
+}
+
+// nonblockingDups holds the files that [CmdExt.SetListenFds] duplicated from
+// non-blocking file descriptors, like the ones of a [net.Listener]. The ExtraFiles
+// of a Cmd outlive SetListenFds, so unlike for Stdin, Stdout and Stderr, the
+// functions from dupFile can't be kept until Exec fails. See stdioFiles.extraFiles.
+var nonblockingDups sync.Map // weak.Pointer[os.File] -> struct{}
+
+// addNonblockingDup adds f, which dupFile returned along with a restore function,
+// to nonblockingDups until f is garbage collected.
+func addNonblockingDup(f *os.File) {
+	key := weak.Make(f)
+	nonblockingDups.Store(key, struct{}{})
+	runtime.AddCleanup(f, func(key weak.Pointer[os.File]) {
+		nonblockingDups.Delete(key)
+	}, key)
+}
+
+// extraFiles makes the files in files that are in nonblockingDups non-blocking
+// again when s is closed, since [os.File.Fd] puts them, and the file descriptors
+// that they were duplicated from, into blocking mode for the new program.
+func (s *stdioFiles) extraFiles(files []*os.File) {
+	for _, f := range files {
+		if _, ok := nonblockingDups.Load(weak.Make(f)); !ok {
+			continue
+		}
+		s.restore = append(s.restore, func() {
+			rc, err := f.SyscallConn()
+			if err != nil {
+				return
+			}
+			_ = rc.Control(func(fd uintptr) {
+				_ = unix.SetNonblock(int(fd), true)
+			})
+		})
+	}
+}
@@ -0,0 +1,51 @@
+//go:build unix || plan9
+
+package exec
+
+import (
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// SupportedSysProcAttrFields returns the names of the [syscall.SysProcAttr] fields
+// that [ExecProcess] and [CmdExt.Exec] honor on the current platform. Fields that are
+// not in the list are ignored, or rejected when [ExecOptions.Strict] is set.
+func SupportedSysProcAttrFields() []string {
+	var fields []string
+	t := reflect.TypeFor[syscall.SysProcAttr]()
+	for i := range t.NumField() {
+		if f := t.Field(i); f.IsExported() && !slices.Contains(unsupportedSysProcAttrFields, f.Name) {
+			fields = append(fields, f.Name)
+		}
+	}
+	return fields
+}
+
+// UnsupportedSysProcAttrError is returned in strict mode when a [syscall.SysProcAttr]
+// sets fields that Exec does not honor on the current platform.
+type UnsupportedSysProcAttrError struct {
+	Fields []string
+}
+
+func (e *UnsupportedSysProcAttrError) Error() string {
+	return "exec: SysProcAttr fields not supported by Exec on " + runtime.GOOS + ": " + strings.Join(e.Fields, ", ")
+}
+
+// checkSysProcAttr returns an [*UnsupportedSysProcAttrError] if sys sets any field
+// that is not in [SupportedSysProcAttrFields].
+func checkSysProcAttr(sys *syscall.SysProcAttr) error {
+	var fields []string
+	v := reflect.ValueOf(sys).Elem()
+	for _, name := range unsupportedSysProcAttrFields {
+		if f := v.FieldByName(name); f.IsValid() && !f.IsZero() {
+			fields = append(fields, name)
+		}
+	}
+	if len(fields) > 0 {
+		return &UnsupportedSysProcAttrError{Fields: fields}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/jcbhmr/go-exec/internal/constructor"
+)
+
+// The offsets of a new time namespace can only be written to
+// /proc/<pid>/timens_offsets, which applies to the main thread of the process. So,
+// like for a new user namespace, Exec re-executes the current executable with the
+// offsets in the environment variable below, and the constructor in
+// package nsenter unshares the time namespace and writes them from the main
+// thread before the Go runtime starts any others.
+const timensOffsetsEnv = "GO_EXEC_TIMENS_OFFSETS"
+
+var _ = unsetEnv(timensOffsetsEnv)
+
+// hasTimeOffsets reports whether opts has offsets for a new time namespace.
+func hasTimeOffsets(opts *ExecOptions) bool {
+	return opts.MonotonicOffset != 0 || opts.BoottimeOffset != 0
+}
+
+// checkTimens starts the current executable in a new time namespace with the
+// offsets of s.opts, if there are any, and in the new user namespace of attr first,
+// so that Exec can fail while it can still roll back if the offsets can't be set.
+func checkTimens(s *execState, attr *syscall.ProcAttr) error {
+	if !hasTimeOffsets(s.opts) {
+		return nil
+	}
+	return s.doReversible("unshare", "unshare(CLONE_NEWTIME)", func() (func(), error) {
+		if !constructor.Linked {
+			return nil, errors.New("time namespace offsets need " + needsConstructor)
+		}
+		cmd, err := EntrypointCommand(checkEntrypoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		if attr != nil && needsUserns(attr.Sys) {
+			cmd.Env = append(cmd.Env, usernsEnviron(attr.Sys)...)
+		}
+		cmd.Env = append(cmd.Env, timensOffsetsEnv+"="+string(formatTimeOffsets(s.opts.MonotonicOffset, s.opts.BoottimeOffset)))
+		err = runCheck((*exec.Cmd)(cmd), "unshare")
+		if err != nil {
+			return nil, err
+		}
+		return func() {}, nil
+	})
+}
+
+// formatTimeOffsets returns the contents of timens_offsets for the given offsets
+// of CLOCK_MONOTONIC and CLOCK_BOOTTIME.
+func formatTimeOffsets(monotonic time.Duration, boottime time.Duration) []byte {
+	var data []byte
+	for _, c := range []struct {
+		name   string
+		offset time.Duration
+	}{{"monotonic", monotonic}, {"boottime", boottime}} {
+		if c.offset == 0 {
+			continue
+		}
+		// The nanoseconds can't be negative.
+		sec, nsec := c.offset/time.Second, c.offset%time.Second
+		if nsec < 0 {
+			sec, nsec = sec-1, nsec+time.Second
+		}
+		data = append(data, fmt.Sprintf("%s %d %d\n", c.name, sec, nsec)...)
+	}
+	return data
+}
@@ -0,0 +1,14 @@
+package exec
+
+import "golang.org/x/sys/unix"
+
+// unix.TIOCGPGRP and unix.TIOCSPGRP overflow the int request argument of the ioctl
+// wrappers on AIX. See execProcessUnix in exec_libc.go.
+
+func tcgetpgrp(fd int) (int, error) {
+	return 0, unix.ENOSYS
+}
+
+func tcsetpgrp(fd int, pgrp int) error {
+	return unix.ENOSYS
+}
@@ -0,0 +1,15 @@
+//go:build unix && !aix
+
+package exec
+
+import "golang.org/x/sys/unix"
+
+// tcgetpgrp returns the foreground process group of the terminal fd.
+func tcgetpgrp(fd int) (int, error) {
+	return unix.IoctlGetInt(fd, unix.TIOCGPGRP)
+}
+
+// tcsetpgrp makes pgrp the foreground process group of the terminal fd.
+func tcsetpgrp(fd int, pgrp int) error {
+	return unix.IoctlSetPointerInt(fd, unix.TIOCSPGRP, pgrp)
+}
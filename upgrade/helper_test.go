@@ -0,0 +1,41 @@
+//go:build unix
+
+package upgrade_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// helpers are the functions that TestHelperProcess can run, by name.
+var helpers = map[string]func(args []string){}
+
+// helperCommand returns a command that runs helpers[name] with args in a copy of
+// the test binary.
+func helperCommand(t *testing.T, name string, args ...string) *exec.Cmd {
+	t.Helper()
+	if _, ok := helpers[name]; !ok {
+		t.Fatalf("no helper named %q", name)
+	}
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestHelperProcess$", "--", name}, args...)...)
+	cmd.Env = append(os.Environ(), "GO_EXEC_WANT_HELPER_PROCESS=1")
+	return cmd
+}
+
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_EXEC_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "helper: no helper name")
+		os.Exit(2)
+	}
+	helpers[args[1]](args[2:])
+	os.Exit(0)
+}
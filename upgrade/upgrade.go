@@ -0,0 +1,142 @@
+//go:build unix
+
+// Package upgrade replaces a running server with a newly installed version of
+// itself without closing its listeners. It is kept apart from package exec because
+// it needs package net, which makes a program that imports it dynamically linked
+// unless it is built without cgo.
+package upgrade
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+
+	jcbhmrexec "github.com/jcbhmr/go-exec"
+)
+
+// Upgrader replaces the running program with a newly installed version of it, in
+// place, while keeping its listeners open, like nginx's binary upgrade. Because the
+// process ID doesn't change, whatever supervises the program doesn't notice, and
+// connections that arrive in the meantime wait in the listen queue.
+//
+// The program gets its listeners from [Upgrader.Listen] or registers them with
+// [Upgrader.AddListener]. [Upgrader.Upgrade] passes them on by name with the socket
+// activation protocol of systemd (see [jcbhmrexec.CmdExt.SetListenFds]), and the
+// same calls to Listen in the new version return them instead of creating new ones.
+//
+// The zero value is ready to use. An Upgrader is safe for concurrent use.
+type Upgrader struct {
+	// Path is the executable of the new version. If Path is empty, it is the one
+	// that the current process was started from, as returned by [os.Executable],
+	// which may have been replaced since.
+	Path string
+
+	// Args holds the command-line arguments of the new version, including the
+	// command name. If Args is nil, they are the same as [os.Args].
+	Args []string
+
+	// Env is the environment of the new version. If Env is nil, it is the
+	// environment of the current process.
+	Env []string
+
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	listeners []jcbhmrexec.ListenFd
+}
+
+// Listen returns the listener named name that the previous version of the program
+// passed on, or, if there is none, a new one from [net.Listen] with network and
+// address. Either way, it registers the listener to be passed on by Upgrade.
+func (u *Upgrader) Listen(name string, network string, address string) (net.Listener, error) {
+	f, err := u.Inherited(name)
+	if err != nil {
+		return nil, err
+	}
+	var ln net.Listener
+	if f != nil {
+		ln, err = net.FileListener(f)
+		_ = f.Close()
+	} else {
+		ln, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.AddListener(name, ln)
+	return ln, nil
+}
+
+// AddListener registers ln to be passed on by Upgrade with the given name. ln can
+// be anything that [jcbhmrexec.ListenFd.File] accepts, not only a [net.Listener].
+func (u *Upgrader) AddListener(name string, ln any) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.listeners = append(u.listeners, jcbhmrexec.ListenFd{Name: name, File: ln})
+}
+
+// Inherited returns the file named name that the previous version of the program
+// passed on, or nil if there is none. Each file is only returned once.
+func (u *Upgrader) Inherited(name string) (*os.File, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.inherited == nil {
+		fds, err := jcbhmrexec.ListenFds()
+		if err != nil {
+			return nil, err
+		}
+		u.inherited = make(map[string]*os.File, len(fds))
+		for _, fd := range fds {
+			u.inherited[fd.Name] = fd.File.(*os.File)
+		}
+	}
+	f := u.inherited[name]
+	delete(u.inherited, name)
+	return f, nil
+}
+
+// Upgrade replaces the current process with the new version of the program using
+// [jcbhmrexec.CmdExt.Exec], passing on the registered listeners. Like Exec, it only
+// returns if it fails, in which case the current version can keep running.
+func (u *Upgrader) Upgrade() error {
+	path := u.Path
+	if path == "" {
+		var err error
+		path, err = os.Executable()
+		if err != nil {
+			return err
+		}
+	}
+	args := u.Args
+	if args == nil {
+		args = os.Args
+	}
+	if len(args) == 0 {
+		return errors.New("upgrade: no command-line arguments for the new version")
+	}
+
+	env := u.Env
+	if env == nil {
+		env = os.Environ()
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	cmd := &exec.Cmd{Path: path, Args: args, Env: env}
+	err := (*jcbhmrexec.CmdExt)(cmd).SetListenFds(u.listeners...)
+	if err != nil {
+		return err
+	}
+	// Close the duplicates that SetListenFds made of listeners that aren't files. If
+	// Exec fails, it has made them non-blocking again by then, and with them the
+	// listeners, which share their file status flags.
+	defer func() {
+		for i, f := range cmd.ExtraFiles {
+			if f != u.listeners[i].File {
+				_ = f.Close()
+			}
+		}
+	}()
+	return (*jcbhmrexec.CmdExt)(cmd).Exec()
+}
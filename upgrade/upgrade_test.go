@@ -0,0 +1,143 @@
+//go:build unix
+
+package upgrade_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jcbhmr/go-exec/upgrade"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	// upgrade-server serves one line per connection, answering with its generation
+	// and process ID, until it is told to upgrade to the next generation or to quit.
+	helpers["upgrade-server"] = func(args []string) {
+		gen, _ := strconv.Atoi(args[0])
+		var u upgrade.Upgrader
+		ln, err := u.Listen("line", "tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if gen == 0 {
+			fmt.Println(ln.Addr())
+		}
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			fmt.Fprintf(conn, "%d %d %s", gen, os.Getpid(), line)
+			_ = conn.Close()
+			switch line {
+			case "upgrade\n":
+				u.Args = []string{os.Args[0], "-test.run=^TestHelperProcess$", "--", "upgrade-server", strconv.Itoa(gen + 1)}
+				err := u.Upgrade()
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			case "quit\n":
+				os.Exit(0)
+			}
+		}
+	}
+}
+
+func TestUpgrader(t *testing.T) {
+	var stderr strings.Builder
+	cmd := helperCommand(t, "upgrade-server", "0")
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	addr, _ := bufio.NewReader(stdout).ReadString('\n')
+	addr = strings.TrimSpace(addr)
+
+	send := func(line string) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("%v\n%s", err, stderr.String())
+		}
+		defer conn.Close()
+		fmt.Fprintln(conn, line)
+		reply, _ := bufio.NewReader(conn).ReadString('\n')
+		return reply
+	}
+
+	pid := cmd.Process.Pid
+	for _, tt := range []struct{ line, want string }{
+		{"hello", fmt.Sprintf("0 %d hello\n", pid)},
+		{"upgrade", fmt.Sprintf("0 %d upgrade\n", pid)},
+		{"hello", fmt.Sprintf("1 %d hello\n", pid)},
+		{"upgrade", fmt.Sprintf("1 %d upgrade\n", pid)},
+		{"quit", fmt.Sprintf("2 %d quit\n", pid)},
+	} {
+		if got := send(tt.line); got != tt.want {
+			t.Fatalf("sent %q, expected %q, got %q\n%s", tt.line, tt.want, got, stderr.String())
+		}
+	}
+
+	t.Run("fails", func(t *testing.T) {
+		u := upgrade.Upgrader{Path: "/nonexistent/go-exec-test"}
+		ln, err := u.Listen("line", "tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		if err := u.Upgrade(); err == nil {
+			t.Fatal("expected Upgrade to fail")
+		}
+
+		// The current version keeps running, and its listener is still non-blocking, so
+		// that Close interrupts Accept.
+		rc, err := ln.(syscall.Conn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var flags int
+		var ferr error
+		if err := rc.Control(func(fd uintptr) {
+			flags, ferr = unix.FcntlInt(fd, unix.F_GETFL, 0)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if ferr != nil {
+			t.Fatal(ferr)
+		}
+		if flags&unix.O_NONBLOCK == 0 {
+			t.Error("the listener is in blocking mode")
+		}
+		accepted := make(chan error, 1)
+		go func() {
+			_, err := ln.Accept()
+			accepted <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		_ = ln.Close()
+		select {
+		case err := <-accepted:
+			if err == nil {
+				t.Error("expected Accept to fail after Close")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close didn't interrupt Accept")
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"github.com/jcbhmr/go-exec/internal/constructor"
+	"golang.org/x/sys/unix"
+)
+
+// The kernel only lets a single-threaded process unshare(2) its user namespace,
+// and a Go program never is one. So when SysProcAttr asks for a new user namespace,
+// Exec re-executes the current executable with the environment variables below, and
+// the constructor in package nsenter unshares the user namespace before the Go
+// runtime starts any threads. A helper process that it forks writes the ID mappings
+// from outside, since the process itself can't map IDs to the ones it had. The
+// execRest entrypoint then carries out the rest of the Exec in the new user
+// namespace. See reexec_linux.go.
+const (
+	usernsEnv          = "GO_EXEC_USERNS"
+	usernsUidMapEnv    = "GO_EXEC_USERNS_UID_MAP"
+	usernsGidMapEnv    = "GO_EXEC_USERNS_GID_MAP"
+	usernsSetgroupsEnv = "GO_EXEC_USERNS_SETGROUPS"
+)
+
+// The constructor has used the environment variables by the time that Go code runs,
+// so they are unset before anything can pass them on to a process of its own.
+var _ = unsetEnv(usernsEnv, usernsUidMapEnv, usernsGidMapEnv, usernsSetgroupsEnv)
+
+// needsUserns reports whether Exec with sys creates a new user namespace.
+func needsUserns(sys *unix.SysProcAttr) bool {
+	return sys != nil && (sys.Unshareflags|sys.Cloneflags)&unix.CLONE_NEWUSER != 0
+}
+
+// checkUserns starts the current executable in a new user namespace with the ID
+// mappings of attr, if there are any, so that Exec can fail while it can still roll
+// back if the user namespace can't be created.
+func checkUserns(s *execState, attr *syscall.ProcAttr) error {
+	if attr == nil || !needsUserns(attr.Sys) {
+		return nil
+	}
+	sys := attr.Sys
+	return s.doReversible("unshare", "clone(CLONE_NEWUSER)", func() (func(), error) {
+		if !constructor.Linked {
+			return nil, errors.New("a new user namespace needs " + needsConstructor)
+		}
+		cmd, err := EntrypointCommand(checkEntrypoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags:                 syscall.CLONE_NEWUSER,
+			UidMappings:                sys.UidMappings,
+			GidMappings:                sys.GidMappings,
+			GidMappingsEnableSetgroups: sys.GidMappingsEnableSetgroups,
+		}
+		err = runCheck((*exec.Cmd)(cmd), "unshare")
+		if err != nil {
+			return nil, err
+		}
+		return func() {}, nil
+	})
+}
+
+// usernsEnviron returns the environment variables that make the constructor create
+// the new user namespace of sys.
+func usernsEnviron(sys *unix.SysProcAttr) []string {
+	env := []string{usernsEnv + "=1"}
+	if sys.UidMappings != nil {
+		env = append(env, usernsUidMapEnv+"="+string(formatIDMappings(sys.UidMappings)))
+	}
+	if sys.GidMappings != nil {
+		setgroups := "deny"
+		if sys.GidMappingsEnableSetgroups {
+			setgroups = "allow"
+		}
+		env = append(env,
+			usernsSetgroupsEnv+"="+setgroups,
+			usernsGidMapEnv+"="+string(formatIDMappings(sys.GidMappings)),
+		)
+	}
+	return env
+}
+
+// execUnshare carries out the rest of an Exec, which execProcessThread has done up to
+// unshare(2), by executing the current executable so that it enters a new user
+// namespace, or a new time namespace with offsets, and the execRest entrypoint in
+// it.
+func execUnshare(s *execState, argv0 string, argv []string, attr *syscall.ProcAttr, sys *unix.SysProcAttr, unshareflags uintptr) error {
+	rest := *sys
+	rest.Unshareflags = unshareflags
+	rest.Cloneflags = 0
+	rest.UseCgroupFD = false
+	rest.Setsid = false
+	rest.Setpgid = false
+	rest.Foreground = false
+
+	var env []string
+	var steps []ExecStep
+	if unshareflags&unix.CLONE_NEWUSER != 0 {
+		rest.Unshareflags &^= unix.CLONE_NEWUSER
+		env = usernsEnviron(sys)
+		steps = usernsSteps(sys)
+	}
+	if hasTimeOffsets(s.opts) {
+		rest.Unshareflags &^= unix.CLONE_NEWTIME
+		offsets := formatTimeOffsets(s.opts.MonotonicOffset, s.opts.BoottimeOffset)
+		env = append(env, timensOffsetsEnv+"="+string(offsets))
+		steps = append(steps,
+			ExecStep{Op: "unshare", Call: "unshare(CLONE_NEWTIME)"},
+			ExecStep{Op: "timens_offsets", Call: procWriteCall("timens_offsets", offsets)},
+		)
+	}
+	req := newExecRequest(s, argv0, argv, attr, &rest)
+	req.MonotonicOffset, req.BoottimeOffset = 0, 0
+	err := reexec(s, execRestEntrypoint, req, attr, env...)
+	if err != nil || !s.dryRun {
+		return err
+	}
+	return req.plan(s, steps...)
+}
+
+// usernsSteps returns the steps that the constructor and its helper take to create
+// the new user namespace of sys.
+func usernsSteps(sys *unix.SysProcAttr) []ExecStep {
+	steps := []ExecStep{{Op: "unshare", Call: "unshare(CLONE_NEWUSER)"}}
+	if sys.GidMappings != nil {
+		setgroups := "deny"
+		if sys.GidMappingsEnableSetgroups {
+			setgroups = "allow"
+		}
+		steps = append(steps,
+			ExecStep{Op: "setgroups", Call: procWriteCall("setgroups", []byte(setgroups))},
+			ExecStep{Op: "gid_map", Call: procWriteCall("gid_map", formatIDMappings(sys.GidMappings))},
+		)
+	}
+	if sys.UidMappings != nil {
+		steps = append(steps, ExecStep{Op: "uid_map", Call: procWriteCall("uid_map", formatIDMappings(sys.UidMappings))})
+	}
+	return steps
+}
+
+// procWriteCall renders a write of data to /proc/<pid>/name of the current process
+// for an ExecStep.
+func procWriteCall(name string, data []byte) string {
+	return fmt.Sprintf("write(%q, %q)", "/proc/"+strconv.Itoa(os.Getpid())+"/"+name, data)
+}